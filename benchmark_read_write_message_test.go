@@ -15,6 +15,8 @@ package quickws
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -101,9 +103,103 @@ type testConn struct {
 	buf *bytes.Buffer
 }
 
+func newBenchConn(b *testing.B) *Conn {
+	var conf Config
+	if err := conf.defaultSetting(); err != nil {
+		b.Fatal(err)
+	}
+	return &Conn{Config: &conf}
+}
+
+// 服务端的Conn写到本地的tcp连接, 对端读出来直接丢弃
+func newBenchTCPConn(b *testing.B) *Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		peer, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+
+	nc, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { nc.Close() })
+
+	c := newBenchConn(b)
+	c.c = nc
+	c.writev = canWritev(nc)
+	return c
+}
+
+// 大消息: header和payload复制到一起再写 vs writev
+func Benchmark_WriteMessage_Writev(b *testing.B) {
+	for _, size := range []int{4 * 1024, 64 * 1024, 1024 * 1024} {
+		payload := bytes.Repeat([]byte{1}, size)
+		for _, writev := range []bool{false, true} {
+			name := fmt.Sprintf("%dk.copy", size/1024)
+			if writev {
+				name = fmt.Sprintf("%dk.writev", size/1024)
+			}
+
+			b.Run(name, func(b *testing.B) {
+				c := newBenchTCPConn(b)
+				c.writev = writev
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := c.WriteMessage(opcode.Binary, payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// 很多小消息: 每个消息一次系统调用 vs 批量写
+func Benchmark_WriteMessages(b *testing.B) {
+	msgs := make([]Message, 32)
+	for i := range msgs {
+		msgs[i] = Message{Op: opcode.Binary, Payload: bytes.Repeat([]byte{1}, 128)}
+	}
+
+	b.Run("WriteMessage", func(b *testing.B) {
+		c := newBenchTCPConn(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, m := range msgs {
+				if err := c.WriteMessage(m.Op, m.Payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("WriteMessages", func(b *testing.B) {
+		c := newBenchTCPConn(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := c.WriteMessages(msgs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func Benchmark_WriteMessage(b *testing.B) {
 	b.Run("1.case", func(b *testing.B) {
-		var c Conn
+		c := newBenchConn(b)
 		buf2 := bytes.NewBuffer(make([]byte, 0, 1024))
 		c.c = &testConn{buf: buf2}
 		buf := make([]byte, 1024)
@@ -124,7 +220,7 @@ func Benchmark_ReadMessage(b *testing.B) {
 	})
 
 	b.Run("windows", func(b *testing.B) {
-		var c Conn
+		c := newBenchConn(b)
 		buf2 := bytes.NewBuffer(make([]byte, 0, 1024+enum.MaxFrameHeaderSize))
 
 		c.c = &testConn{buf: buf2}
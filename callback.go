@@ -13,6 +13,8 @@
 // limitations under the License.
 package quickws
 
+import "io"
+
 type (
 	Callback interface {
 		OnOpen(*Conn)
@@ -21,6 +23,14 @@ type (
 	}
 )
 
+// 流式读取的回调
+// Callback同时实现了StreamCallback时, ReadLoop不会再缓存整个消息, 而是把text和binary消息以io.Reader的形式交给OnMessageReader
+// 控制帧(ping, pong, close)还是走OnMessage
+// r只在OnMessageReader中有效, 没有读完的数据会被丢弃
+type StreamCallback interface {
+	OnMessageReader(*Conn, Opcode, io.Reader)
+}
+
 type (
 	OnOpenFunc func(*Conn)
 )
@@ -62,6 +72,22 @@ func (o OnCloseFunc) OnClose(c *Conn, err error) {
 	o(c, err)
 }
 
+// 只设置OnMessageReader, 流式读取消息
+type OnMessageReaderFunc func(*Conn, Opcode, io.Reader)
+
+func (o OnMessageReaderFunc) OnOpen(_ *Conn) {
+}
+
+func (o OnMessageReaderFunc) OnMessage(_ *Conn, _ Opcode, _ []byte) {
+}
+
+func (o OnMessageReaderFunc) OnMessageReader(c *Conn, op Opcode, r io.Reader) {
+	o(c, op, r)
+}
+
+func (o OnMessageReaderFunc) OnClose(_ *Conn, _ error) {
+}
+
 type funcToCallback struct {
 	onOpen    func(*Conn)
 	onMessage func(*Conn, Opcode, []byte)
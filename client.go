@@ -16,6 +16,7 @@ package quickws
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -40,8 +41,11 @@ type DialOption struct {
 	Header               http.Header
 	u                    *url.URL
 	tlsConfig            *tls.Config
+	proxyOption          proxyOption // 代理的tls配置, CONNECT的header和认证
 	dialTimeout          time.Duration
 	bindClientHttpHeader *http.Header // 握手成功之后, 客户端获取http.Header,
+	http2                bool         // 使用HTTP/2 Extended CONNECT(RFC 8441)握手
+	session              any          // 握手成功之后, OnOpen之前设置的session
 	Config
 }
 
@@ -57,6 +61,11 @@ func ClientOptionToConf(opts ...ClientOption) *DialOption {
 }
 
 func DialConf(rawUrl string, conf *DialOption) (*Conn, error) {
+	return DialConfContext(context.Background(), rawUrl, conf)
+}
+
+// 和DialConf一样, ctx取消或者超时, 握手会中断
+func DialConfContext(ctx context.Context, rawUrl string, conf *DialOption) (*Conn, error) {
 	u, err := url.Parse(rawUrl)
 	if err != nil {
 		return nil, err
@@ -67,12 +76,18 @@ func DialConf(rawUrl string, conf *DialOption) (*Conn, error) {
 	if conf.Header == nil {
 		conf.Header = make(http.Header)
 	}
-	return conf.Dial()
+	return conf.DialContext(ctx)
 }
 
 // https://datatracker.ietf.org/doc/html/rfc6455#section-4.1
 // 又是一顿if else, 咬文嚼字
 func Dial(rawUrl string, opts ...ClientOption) (*Conn, error) {
+	return DialContext(context.Background(), rawUrl, opts...)
+}
+
+// 和Dial一样, ctx会作用于整个握手过程: tcp连接, proxy的CONNECT, tls握手, 读取101响应
+// ctx取消或者超时, 握手会中断并返回ctx.Err()
+func DialContext(ctx context.Context, rawUrl string, opts ...ClientOption) (*Conn, error) {
 	var dial DialOption
 	u, err := url.Parse(rawUrl)
 	if err != nil {
@@ -93,7 +108,7 @@ func Dial(rawUrl string, opts ...ClientOption) (*Conn, error) {
 		o(&dial)
 	}
 
-	return dial.Dial()
+	return dial.DialContext(ctx)
 }
 
 // 准备握手的数据
@@ -158,14 +173,12 @@ func (d *DialOption) validateRsp(rsp *http.Response, secWebSocket string) error
 		return ErrSecWebSocketAccept
 	}
 
-	// TODO 5点
-
-	// TODO 6点
+	// 第5点和第6点在validateNegotiation里面检查, HTTP/2的握手也需要
 	return nil
 }
 
 // wss已经修改为https
-func (d *DialOption) tlsConn(c net.Conn) net.Conn {
+func (d *DialOption) tlsConn(ctx context.Context, c net.Conn) (net.Conn, error) {
 	if d.u.Scheme == "https" {
 		cfg := d.tlsConfig
 		if cfg == nil {
@@ -174,6 +187,10 @@ func (d *DialOption) tlsConn(c net.Conn) net.Conn {
 			cfg = cfg.Clone()
 		}
 
+		if d.http2 {
+			cfg.NextProtos = []string{http2NextProto}
+		}
+
 		if cfg.ServerName == "" {
 			host := d.u.Host
 			if pos := strings.Index(host, ":"); pos != -1 {
@@ -181,13 +198,90 @@ func (d *DialOption) tlsConn(c net.Conn) net.Conn {
 			}
 			cfg.ServerName = host
 		}
-		return tls.Client(c, cfg)
+		tlsConn := tls.Client(c, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		if d.http2 && tlsConn.ConnectionState().NegotiatedProtocol != http2NextProto {
+			tlsConn.Close()
+			return nil, ErrExtendedConnectNotSupported
+		}
+		return tlsConn, nil
+	}
+
+	return c, nil
+}
+
+// 把Dialer转成带ctx的dial函数
+// 如果Dialer没有实现ContextDialer, ctx取消之后直接返回, 后台的Dial返回之后关闭连接
+func dialerToDialContext(dialer Dialer) dialContextFunc {
+	if cd, ok := dialer.(ContextDialer); ok {
+		return cd.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		type result struct {
+			c   net.Conn
+			err error
+		}
+
+		done := make(chan result, 1)
+		go func() {
+			c, err := dialer.Dial(network, addr)
+			done <- result{c: c, err: err}
+		}()
+
+		select {
+		case r := <-done:
+			return r.c, r.err
+		case <-ctx.Done():
+			go func() {
+				if r := <-done; r.c != nil {
+					r.c.Close()
+				}
+			}()
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	return c
+// ctx取消的时候, 设置一个过期的deadline, 让阻塞在conn上的读写返回
+// 返回的stop函数用于停止监听, 如果是ctx导致的中断, stop返回ctx.Err()
+func watchContext(ctx context.Context, c net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return <-interrupted
+	}
 }
 
 func (d *DialOption) Dial() (wsCon *Conn, err error) {
+	return d.DialContext(context.Background())
+}
+
+// 和Dial一样, 如果配置了dialTimeout, 会和ctx的deadline取最小值
+func (d *DialOption) DialContext(ctx context.Context) (wsCon *Conn, err error) {
+	if d.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialTimeout)
+		defer cancel()
+	}
+
 	// scheme ws -> http
 	// scheme wss -> https
 	req, secWebSocket, err := d.handshake()
@@ -198,15 +292,14 @@ func (d *DialOption) Dial() (wsCon *Conn, err error) {
 	var conn net.Conn
 
 	hostName := hostname.GetHostName(d.u)
-	dialFunc := net.DialTimeout
+	var dialer net.Dialer
+	dialContext := dialContextFunc(dialer.DialContext)
 	if d.dialFunc != nil {
 		dialInterface, err := d.dialFunc()
 		if err != nil {
 			return nil, err
 		}
-		dialFunc = func(network, address string, timeout time.Duration) (net.Conn, error) {
-			return dialInterface.Dial(network, address)
-		}
+		dialContext = dialerToDialContext(dialInterface)
 	}
 
 	if d.proxyFunc != nil {
@@ -214,15 +307,16 @@ func (d *DialOption) Dial() (wsCon *Conn, err error) {
 		if err != nil {
 			return nil, err
 		}
-		dialFunc = newhttpProxy(proxyURL, dialFunc).DialTimeout
+		if dialContext, err = newProxyDialContext(proxyURL, dialContext, &d.proxyOption); err != nil {
+			return nil, err
+		}
 	}
 
-	conn, err = dialFunc("tcp", hostName, d.dialTimeout)
+	conn, err = dialContext(ctx, "tcp", hostName)
 	if err != nil {
 		return nil, err
 	}
 
-	conn = d.tlsConn(conn)
 	defer func() {
 		if err != nil && conn != nil {
 			conn.Close()
@@ -230,13 +324,29 @@ func (d *DialOption) Dial() (wsCon *Conn, err error) {
 		}
 	}()
 
-	err = conn.SetDeadline(time.Time{})
+	tlsConn, err := d.tlsConn(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	conn = tlsConn
+
+	if d.http2 {
+		return d.dialH2(ctx, conn)
+	}
+
+	stop := watchContext(ctx, conn)
 	if err = req.Write(conn); err != nil {
-		return
+		if ctxErr := stop(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, err
 	}
 
 	br := bufio.NewReader(bufio.NewReader(conn))
 	rsp, err := http.ReadResponse(br, req)
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -245,19 +355,18 @@ func (d *DialOption) Dial() (wsCon *Conn, err error) {
 		*d.bindClientHttpHeader = rsp.Header.Clone()
 	}
 
-	pd, err := deflate.GetConnPermessageDeflate(rsp.Header)
+	if err = d.validateRsp(rsp, secWebSocket); err != nil {
+		return
+	}
+
+	subprotocol, exts, err := d.validateNegotiation(rsp)
 	if err != nil {
 		return nil, err
 	}
-	if d.Decompression {
-		pd.Decompression = pd.Enable && d.Decompression
-	}
-	if d.Compression {
-		pd.Compression = pd.Enable && d.Compression
-	}
 
-	if err = d.validateRsp(rsp, secWebSocket); err != nil {
-		return
+	pd, err := d.permessageDeflate(exts)
+	if err != nil {
+		return nil, err
 	}
 
 	// 处理下已经在bufio里面的数据，后面都是直接操作net.Conn，所以需要取出bufio里面已读取的数据
@@ -291,6 +400,77 @@ func (d *DialOption) Dial() (wsCon *Conn, err error) {
 		return nil, err
 	}
 	wsCon.pd = pd
+	wsCon.subprotocol = subprotocol
+	wsCon.extensions = exts
+	if d.session != nil {
+		wsCon.SetSession(d.session)
+	}
+	wsCon.Callback = d.cb
+	wsCon.ready()
+	return wsCon, nil
+}
+
+// 服务端响应的压缩参数
+func (d *DialOption) permessageDeflate(exts []Extension) (pd deflate.PermessageDeflateConf, err error) {
+	pd, err = deflate.GetConnPermessageDeflate(permessageDeflateHeader(exts))
+	if err != nil {
+		return pd, err
+	}
+	if d.Decompression {
+		pd.Decompression = pd.Enable && d.Decompression
+	}
+	if d.Compression {
+		pd.Compression = pd.Enable && d.Compression
+	}
+	return pd, nil
+}
+
+// RFC 8441, 在HTTP/2的stream上面握手, 成功的状态码是200
+func (d *DialOption) dialH2(ctx context.Context, conn net.Conn) (wsCon *Conn, err error) {
+	stream, rsp, err := d.handshakeH2(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			stream.Close()
+		}
+	}()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w %d", ErrWrongStatusCode, rsp.StatusCode)
+	}
+
+	if d.bindClientHttpHeader != nil {
+		*d.bindClientHttpHeader = rsp.Header.Clone()
+	}
+
+	subprotocol, exts, err := d.validateNegotiation(rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	pd, err := d.permessageDeflate(exts)
+	if err != nil {
+		return nil, err
+	}
+
+	var fr fixedreader.FixedReader
+	if d.parseMode == ParseModeWindows {
+		fr.Init(stream, bytespool.GetBytes(1024+enum.MaxFrameHeaderSize))
+	}
+
+	if wsCon, err = newConn(stream, true /* client is true*/, &d.Config, fr, nil); err != nil {
+		return nil, err
+	}
+	wsCon.pd = pd
+	wsCon.subprotocol = subprotocol
+	wsCon.extensions = exts
+	if d.session != nil {
+		wsCon.SetSession(d.session)
+	}
 	wsCon.Callback = d.cb
+	wsCon.ready()
 	return wsCon, nil
 }
@@ -156,7 +156,8 @@ func Test_ClientOption(t *testing.T) {
 	t.Run("ClientOption.WithClientDialTimeout", func(t *testing.T) {})
 	t.Run("6.1 Dial: WithClientBindHTTPHeader and echo Sec-Websocket-Protocol", func(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_, err := Upgrade(w, r)
+			// 服务端只回复自己支持的子协议
+			_, err := Upgrade(w, r, WithServerSubprotocols([]string{"token"}))
 			if err != nil {
 				t.Error(err)
 			}
@@ -181,7 +182,8 @@ func Test_ClientOption(t *testing.T) {
 
 	t.Run("6.2 DialConf: WithClientBindHTTPHeader and echo Sec-Websocket-Protocol", func(t *testing.T) {
 		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			_, err := Upgrade(w, r)
+			// 服务端只回复自己支持的子协议
+			_, err := Upgrade(w, r, WithServerSubprotocols([]string{"token"}))
 			if err != nil {
 				t.Error(err)
 			}
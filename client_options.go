@@ -56,3 +56,48 @@ func WithClientBindHTTPHeader(h *http.Header) ClientOption {
 		o.bindClientHttpHeader = h
 	}
 }
+
+// 7.使用HTTP/2 Extended CONNECT(RFC 8441)握手, 一个websocket连接独占一个HTTP/2连接
+// wss://使用tls + alpn h2, ws://使用h2c(prior knowledge)
+// 服务端需要支持SETTINGS_ENABLE_CONNECT_PROTOCOL
+func WithClientHTTP2() ClientOption {
+	return func(o *DialOption) {
+		o.http2 = true
+	}
+}
+
+// 8.设置连接的session, 握手成功之后, OnOpen之前设置, OnOpen里面可以直接使用c.Session()
+func WithClientSession(v any) ClientOption {
+	return func(o *DialOption) {
+		o.session = v
+	}
+}
+
+// 9.使用环境变量HTTP_PROXY, HTTPS_PROXY, NO_PROXY配置代理, 见ProxyFromEnvironment
+func WithClientProxyFromEnvironment() ClientOption {
+	return func(o *DialOption) {
+		o.proxyFunc = ProxyFromEnvironment
+	}
+}
+
+// 10.配置和https://代理之间的tls.Config, ServerName为空的时候使用代理的域名
+func WithClientProxyTLSConfig(tls *tls.Config) ClientOption {
+	return func(o *DialOption) {
+		o.proxyOption.tlsConfig = tls
+	}
+}
+
+// 11.配置CONNECT请求额外的header, 比如Proxy-Authorization: Bearer xxx
+// 设置了Proxy-Authorization的时候, 不再使用代理url里面的用户名密码
+func WithClientProxyConnectHeader(h http.Header) ClientOption {
+	return func(o *DialOption) {
+		o.proxyOption.header = h
+	}
+}
+
+// 12.配置代理的challenge/response认证, 代理返回407的时候调用, 见ProxyAuthFunc
+func WithClientProxyAuth(auth ProxyAuthFunc) ClientOption {
+	return func(o *DialOption) {
+		o.proxyOption.auth = auth
+	}
+}
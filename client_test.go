@@ -14,12 +14,17 @@
 package quickws
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // 测试客户端Dial, 返回的http.Header
@@ -184,3 +189,82 @@ func Test_Client_Dial_Check_Header(t *testing.T) {
 		}
 	})
 }
+
+// 只接受连接, 不回任何数据
+func newSilentListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return ln
+}
+
+type blockDialer struct {
+	block chan struct{}
+}
+
+func (b *blockDialer) Dial(network, addr string) (net.Conn, error) {
+	<-b.block
+	return nil, errors.New("unreachable")
+}
+
+func Test_DialContext(t *testing.T) {
+	t.Run("cancel while reading response", func(t *testing.T) {
+		ln := newSilentListener(t)
+		defer ln.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, err := DialContext(ctx, "ws://"+ln.Addr().String())
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, need %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("timeout in proxy connect", func(t *testing.T) {
+		ln := newSilentListener(t)
+		defer ln.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := DialContext(ctx, "ws://127.0.0.1:1", WithClientProxyFunc(func(*http.Request) (*url.URL, error) {
+			return url.Parse("http://" + ln.Addr().String())
+		}))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, need %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("custom dialer without DialContext", func(t *testing.T) {
+		b := &blockDialer{block: make(chan struct{})}
+		defer close(b.block)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := DialContext(ctx, "ws://127.0.0.1:1", WithClientDialFunc(func() (Dialer, error) {
+			return b, nil
+		}))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, need %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("dial timeout option", func(t *testing.T) {
+		ln := newSilentListener(t)
+		defer ln.Close()
+
+		_, err := Dial("ws://"+ln.Addr().String(), WithClientDialTimeout(100*time.Millisecond))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, need %v", err, context.DeadlineExceeded)
+		}
+	})
+}
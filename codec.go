@@ -0,0 +1,173 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// 消息的编解码, 实现这个接口可以接入protobuf, msgpack等格式
+type Codec interface {
+	// 编码之后使用的消息类型, 文本格式是Text, 二进制格式是Binary
+	Opcode() Opcode
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// 使用encoding/json, Text消息
+	JSONCodec Codec = jsonCodec{}
+	// 使用encoding/gob, Binary消息, 每个消息都带有类型信息, 可以单独解码
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Opcode() Opcode                     { return opcode.Text }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Opcode() Opcode { return opcode.Binary }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// 子协议对应的Codec, 协商出来的子协议注册过的时候, Conn.Codec()使用对应的Codec
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	"json": JSONCodec,
+	"gob":  GobCodec,
+}}
+
+// 注册子协议对应的Codec, 比如RegisterCodec("proto", myProtobufCodec)
+// 需要同时配置WithServerSubprotocols/WithClientSubprotocols才会协商出这个子协议
+func RegisterCodec(subprotocol string, codec Codec) {
+	codecs.Lock()
+	codecs.m[subprotocol] = codec
+	codecs.Unlock()
+}
+
+func lookupCodec(subprotocol string) Codec {
+	if subprotocol == "" {
+		return nil
+	}
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.m[subprotocol]
+}
+
+// 连接使用的Codec: 协商出来的子协议注册过的Codec, WithServerCodec/WithClientCodec配置的Codec, JSONCodec
+func (c *Conn) Codec() Codec {
+	if cd := lookupCodec(c.subprotocol); cd != nil {
+		return cd
+	}
+	if c.codec != nil {
+		return c.codec
+	}
+	return JSONCodec
+}
+
+// 使用连接的Codec编码v, 再发送
+func WriteValue(c *Conn, v any) error {
+	cd := c.Codec()
+	data, err := cd.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(cd.Opcode(), data)
+}
+
+// 使用NextReader读取下一个消息, 再用连接的Codec解码, 和ReadLoop只能二选一
+func ReadValue[T any](c *Conn) (v T, err error) {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return v, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return v, err
+	}
+	if err = c.Codec().Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecodeMessage, err)
+	}
+	return v, nil
+}
+
+// 编码成json, 使用Text消息发送, 不使用连接的Codec
+func WriteJSON(c *Conn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(opcode.Text, data)
+}
+
+// 使用NextReader读取下一个消息, 边读边解码成json, 和ReadLoop只能二选一
+// 只支持json, 不使用连接的Codec, 需要按协商的子协议解码的时候使用ReadValue
+// 一个消息只能有一个json值, 后面还有数据的时候返回ErrDecodeMessage
+func ReadJSON[T any](c *Conn) (v T, err error) {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return v, err
+	}
+	dec := json.NewDecoder(r)
+	if err = dec.Decode(&v); err != nil {
+		return v, fmt.Errorf("%w: %w", ErrDecodeMessage, err)
+	}
+	var extra json.RawMessage
+	if err = dec.Decode(&extra); err != io.EOF {
+		return v, fmt.Errorf("%w: trailing data after json value", ErrDecodeMessage)
+	}
+	return v, nil
+}
+
+// 把text和binary消息用连接的Codec解码成T之后再调用fn, 控制帧会被忽略
+// 解码失败的时候使用DataCannotAccept关闭连接, OnClose收到ErrDecodeMessage
+// 可以直接用在WithServerOnMessageFunc, WithServerCallbackFunc等需要OnMessage的地方
+func OnTypedMessage[T any](fn func(c *Conn, v T)) OnMessageFunc {
+	return func(c *Conn, op Opcode, payload []byte) {
+		if op != opcode.Text && op != opcode.Binary {
+			return
+		}
+
+		var v T
+		if err := c.Codec().Unmarshal(payload, &v); err != nil {
+			_ = c.writeErrAndOnClose(DataCannotAccept, fmt.Errorf("%w: %w", ErrDecodeMessage, err))
+			c.Close()
+			return
+		}
+		fn(c, v)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+type testRequest struct {
+	ID   int
+	Name string
+}
+
+type testReply struct {
+	ID    int
+	Greet string
+}
+
+// 服务端用连接的Codec解码testRequest, 回复testReply
+func codecCallback(t *testing.T, closed chan error) ServerOption {
+	return WithServerCallbackFunc(nil, OnTypedMessage(func(c *Conn, req testRequest) {
+		if err := WriteValue(c, testReply{ID: req.ID, Greet: "hello " + req.Name}); err != nil {
+			t.Error(err)
+		}
+	}), func(c *Conn, err error) {
+		if closed != nil {
+			closed <- err
+		}
+	})
+}
+
+func Test_Codec(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		ts := newWSServer(t, nil, codecCallback(t, nil))
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err = WriteJSON(c, testRequest{ID: 1, Name: "json"}); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := ReadJSON[testReply](c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.ID != 1 || rsp.Greet != "hello json" {
+			t.Fatalf("got %+v", rsp)
+		}
+	})
+
+	t.Run("json trailing data", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerCallbackFunc(func(c *Conn) {
+			_ = c.WriteMessage(Text, []byte(`{"ID":1} {"ID":2}`))
+			_ = c.WriteMessage(Text, []byte(`{"ID":3}`+" \n"))
+		}, nil, nil))
+
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if _, err = ReadJSON[testReply](c); !errors.Is(err, ErrDecodeMessage) {
+			t.Fatalf("got %v", err)
+		}
+		// 后面的空白不算多余的数据
+		rsp, err := ReadJSON[testReply](c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.ID != 3 {
+			t.Fatalf("got %+v", rsp)
+		}
+	})
+
+	t.Run("subprotocol gob", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerSubprotocols([]string{"gob", "json"}), codecCallback(t, nil))
+		c, err := Dial(HTTPToWS(ts.URL), WithClientSubprotocols([]string{"gob"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.Codec() != GobCodec {
+			t.Fatal("subprotocol did not select gob")
+		}
+
+		if err = WriteValue(c, testRequest{ID: 2, Name: "gob"}); err != nil {
+			t.Fatal(err)
+		}
+		op, r, err := c.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != Binary {
+			t.Fatalf("got op %v", op)
+		}
+		var rsp testReply
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = GobCodec.Unmarshal(data, &rsp); err != nil {
+			t.Fatal(err)
+		}
+		if rsp.ID != 2 || rsp.Greet != "hello gob" {
+			t.Fatalf("got %+v", rsp)
+		}
+
+		if err = WriteValue(c, testRequest{ID: 3, Name: "again"}); err != nil {
+			t.Fatal(err)
+		}
+		rsp, err = ReadValue[testReply](c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.ID != 3 || rsp.Greet != "hello again" {
+			t.Fatalf("got %+v", rsp)
+		}
+	})
+
+	t.Run("decode failure", func(t *testing.T) {
+		closed := make(chan error, 1)
+		ts := newWSServer(t, nil, codecCallback(t, closed))
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if err = c.WriteMessage(Text, []byte("not json")); err != nil {
+			t.Fatal(err)
+		}
+		if err = recvErr(t, closed); !errors.Is(err, ErrDecodeMessage) {
+			t.Fatalf("got %v", err)
+		}
+
+		// 客户端收到DataCannotAccept
+		op, r, err := c.NextReader()
+		if err == nil {
+			t.Fatalf("got op %v, reader %v", op, r)
+		}
+	})
+
+	t.Run("select", func(t *testing.T) {
+		c := &Conn{Config: &Config{}}
+		if c.Codec() != JSONCodec {
+			t.Fatal("default is not json")
+		}
+		c.codec = GobCodec
+		if c.Codec() != GobCodec {
+			t.Fatal("configured codec not used")
+		}
+
+		custom := &gobCodec{}
+		RegisterCodec("x-test-codec", custom)
+		c.subprotocol = "x-test-codec"
+		if c.Codec() != Codec(custom) {
+			t.Fatal("registered codec not used")
+		}
+		c.subprotocol = "unknown"
+		if c.Codec() != GobCodec {
+			t.Fatal("unknown subprotocol should fall back")
+		}
+	})
+}
@@ -304,13 +304,14 @@ func WithClientOnCloseFunc(onClose func(c *Conn, err error)) ClientOption {
 }
 
 // 18. 配置新的dial函数, 这里可以配置socks5代理地址
+// 和WithClientProxyFunc一起使用的时候, 返回的Dialer用来连接代理
 func WithClientDialFunc(dialFunc func() (Dialer, error)) ClientOption {
 	return func(o *DialOption) {
 		o.dialFunc = dialFunc
 	}
 }
 
-// 19. 配置proxy地址
+// 19. 配置proxy地址, 支持http://, https://, socks5://, socks5h://, 用户名密码放在url里面
 func WithClientProxyFunc(proxyFunc func(*http.Request) (*url.URL, error)) ClientOption {
 	return func(o *DialOption) {
 		o.proxyFunc = proxyFunc
@@ -322,13 +323,19 @@ func WithClientProxyFunc(proxyFunc func(*http.Request) (*url.URL, error)) Client
 func WithClientSubprotocols(subprotocols []string) ClientOption {
 	return func(o *DialOption) {
 		o.subProtocols = subprotocols
+		if o.mux {
+			o.subProtocols = appendMuxSubprotocol(subprotocols)
+		}
 	}
 }
 
-// 20.2 设置服务端支持的子协议
+// 20.2 设置服务端支持的子协议, 没有设置的时候不回复Sec-WebSocket-Protocol
 func WithServerSubprotocols(subprotocols []string) ServerOption {
 	return func(o *ConnOption) {
 		o.subProtocols = subprotocols
+		if o.mux {
+			o.subProtocols = appendMuxSubprotocol(subprotocols)
+		}
 	}
 }
 
@@ -395,3 +402,123 @@ func WithServerDecompressAndCompress() ServerOption {
 		o.Decompression = true
 	}
 }
+
+// 23. 流式读取消息, 不会缓存整个消息
+// 23.1 配置服务端流式读取消息的回调
+func WithServerOnMessageReaderFunc(cb OnMessageReaderFunc) ServerOption {
+	return func(o *ConnOption) {
+		o.cb = cb
+	}
+}
+
+// 23.2 配置客户端流式读取消息的回调
+func WithClientOnMessageReaderFunc(cb OnMessageReaderFunc) ClientOption {
+	return func(o *DialOption) {
+		o.cb = cb
+	}
+}
+
+// 24. 配置NextWriter单个分段的大小, 默认是4k
+// 24.1 配置服务端NextWriter单个分段的大小
+func WithServerWriteFragmentSize(size int) ServerOption {
+	return func(o *ConnOption) {
+		o.writeFragmentSize = size
+	}
+}
+
+// 24.2 配置客户端NextWriter单个分段的大小
+func WithClientWriteFragmentSize(size int) ClientOption {
+	return func(o *DialOption) {
+		o.writeFragmentSize = size
+	}
+}
+
+// 25. 配置心跳, 每隔interval发送一个ping, pongTimeout时间内没有收到pong, 使用EndpointGoingAway关闭连接
+// 所有连接共用一个时间轮, 精度是100ms
+// 对端需要回复pong, 如果对端也是quickws, 需要配置WithServerReplyPing或者WithClientReplyPing
+// 25.1 配置服务端心跳
+func WithServerPingInterval(interval, pongTimeout time.Duration) ServerOption {
+	return func(o *ConnOption) {
+		if pongTimeout <= 0 {
+			pongTimeout = interval
+		}
+		o.pingInterval = interval
+		o.pongTimeout = pongTimeout
+	}
+}
+
+// 25.2 配置客户端心跳
+func WithClientPingInterval(interval, pongTimeout time.Duration) ClientOption {
+	return func(o *DialOption) {
+		if pongTimeout <= 0 {
+			pongTimeout = interval
+		}
+		o.pingInterval = interval
+		o.pongTimeout = pongTimeout
+	}
+}
+
+// 26. 配置连接的观察者, 用于统计流量, 帧数, 压缩率, 关闭码等, 可以直接使用Metrics
+// 26.1 配置服务端的观察者
+func WithServerObserver(o Observer) ServerOption {
+	return func(opt *ConnOption) {
+		opt.observer = o
+	}
+}
+
+// 26.2 配置客户端的观察者
+func WithClientObserver(o Observer) ClientOption {
+	return func(opt *DialOption) {
+		opt.observer = o
+	}
+}
+
+// 27. 配置延迟写缓存的最大字节数, 超过之后立即写入, <= 0的时候不限制
+// 27.1 配置服务端延迟写的最大字节数
+func WithServerMaxDelayWriteBytes(n int32) ServerOption {
+	return func(o *ConnOption) {
+		o.maxDelayWriteBytes = n
+	}
+}
+
+// 27.2 配置客户端延迟写的最大字节数
+func WithClientMaxDelayWriteBytes(n int32) ClientOption {
+	return func(o *DialOption) {
+		o.maxDelayWriteBytes = n
+	}
+}
+
+// 28. 配置多路复用, 会把MuxSubprotocol加到支持的子协议里面, 和WithServerSubprotocols/WithClientSubprotocols的顺序无关
+// 协商出MuxSubprotocol之后, c.Mux()返回多路复用层, accept处理对端打开的channel, 返回nil表示拒绝
+// 28.1 配置服务端的多路复用
+func WithServerMux(accept func(*Channel) ChannelCallback) ServerOption {
+	return func(o *ConnOption) {
+		o.mux = true
+		o.muxAccept = accept
+		o.subProtocols = appendMuxSubprotocol(o.subProtocols)
+	}
+}
+
+// 28.2 配置客户端的多路复用, DialMux和MuxPool会自动协商MuxSubprotocol
+func WithClientMux(accept func(*Channel) ChannelCallback) ClientOption {
+	return func(o *DialOption) {
+		o.mux = true
+		o.muxAccept = accept
+		o.subProtocols = appendMuxSubprotocol(o.subProtocols)
+	}
+}
+
+// 29. 配置默认的Codec, 协商出来的子协议注册过Codec(RegisterCodec)的时候优先使用子协议的
+// 29.1 配置服务端默认的Codec
+func WithServerCodec(codec Codec) ServerOption {
+	return func(o *ConnOption) {
+		o.codec = codec
+	}
+}
+
+// 29.2 配置客户端默认的Codec
+func WithClientCodec(codec Codec) ClientOption {
+	return func(o *DialOption) {
+		o.codec = codec
+	}
+}
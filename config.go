@@ -15,6 +15,7 @@
 package quickws
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/http"
@@ -25,6 +26,7 @@ import (
 	"github.com/antlabs/wsutil/enum"
 )
 
+// Deprecated: WithClientDialFunc和WithClientProxyFunc可以同时设置, dialFunc返回的Dialer用来连接代理
 var ErrDialFuncAndProxyFunc = errors.New("dialFunc and proxyFunc can't be set at the same time")
 
 // 握手
@@ -37,6 +39,11 @@ type DialerTimeout interface {
 	DialTimeout(network, addr string, timeout time.Duration) (c net.Conn, err error)
 }
 
+// 带ctx的握手, golang.org/x/net/proxy里面的Dialer大多实现了这个接口
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (c net.Conn, err error)
+}
+
 // Config的配置，有两个种用法
 // 一种是声明一个全局的配置，后面不停使用。
 // 另外一种是局部声明一个配置，然后使用WithXXX函数设置配置
@@ -44,19 +51,36 @@ type Config struct {
 	cb                              Callback
 	deflate.PermessageDeflateConf   // 静态配置, 从WithXXX函数中获取
 	tcpNoDelay                      bool
-	replyPing                       bool              // 开启自动回复
-	ignorePong                      bool              // 忽略pong消息
-	disableBufioClearHack           bool              // 关闭bufio的clear hack优化
-	utf8Check                       func([]byte) bool // utf8检查
-	readTimeout                     time.Duration     // 读超时时间
-	windowsMultipleTimesPayloadSize float32           // 设置几倍(1024+14)的payload大小
-	bufioMultipleTimesPayloadSize   float32           // 设置几倍(1024)的payload大小
-	parseMode                       parseMode         // 解析模式
-	maxDelayWriteNum                int32             // 最大延迟包的个数, 默认值为10
-	delayWriteInitBufferSize        int32             // 延迟写入的初始缓冲区大小, 默认值是8k
-	maxDelayWriteDuration           time.Duration     // 最大延迟时间, 默认值是10ms
-	subProtocols                    []string          // 设置支持的子协议
-	readMaxMessage                  int64             //最大消息大小
+	replyPing                       bool                                   // 开启自动回复
+	ignorePong                      bool                                   // 忽略pong消息
+	disableBufioClearHack           bool                                   // 关闭bufio的clear hack优化
+	utf8Check                       func([]byte) bool                      // utf8检查
+	readTimeout                     time.Duration                          // 读超时时间
+	windowsMultipleTimesPayloadSize float32                                // 设置几倍(1024+14)的payload大小
+	bufioMultipleTimesPayloadSize   float32                                // 设置几倍(1024)的payload大小
+	parseMode                       parseMode                              // 解析模式
+	maxDelayWriteNum                int32                                  // 最大延迟包的个数, 默认值为10
+	delayWriteInitBufferSize        int32                                  // 延迟写入的初始缓冲区大小, 默认值是8k
+	maxDelayWriteDuration           time.Duration                          // 最大延迟时间, 默认值是10ms
+	maxDelayWriteBytes              int32                                  // 最大延迟字节数, 默认值是64k
+	subProtocols                    []string                               // 设置支持的子协议
+	readMaxMessage                  int64                                  //最大消息大小
+	writeFragmentSize               int                                    // NextWriter单个分段的大小, 默认值是4k
+	pingInterval                    time.Duration                          // 主动发送ping的间隔, 默认不发送
+	pongTimeout                     time.Duration                          // 发送ping之后等待pong的超时时间
+	observer                        Observer                               // 观察连接的运行数据, 默认不开启
+	eventLoop                       *EventLoop                             // 服务端使用event loop读数据, 默认不开启
+	checkOrigin                     func(*http.Request) bool               // 服务端检查Origin, 默认只允许同源
+	handshakeHook                   func(*http.Request, http.Header) error // 服务端握手钩子, 可以拒绝握手或者添加响应头
+	responseHeader                  http.Header                            // 服务端101响应里面额外的header
+	subprotocolRequired             bool                                   // 服务端没有匹配的子协议时拒绝握手
+	sessionFunc                     func(*http.Request) any                // 服务端握手成功之后, OnOpen之前初始化session
+	rateLimit                       *RateLimit                             // 服务端读限速, 默认不开启
+	writeQueueSize                  int                                    // 服务端发送队列的大小, 0是同步写
+	writeQueuePolicy                WriteQueuePolicy                       // 服务端发送队列满了之后的处理策略
+	mux                             bool                                   // 协商出MuxSubprotocol的时候开启多路复用
+	muxAccept                       func(*Channel) ChannelCallback         // 对端打开channel的时候调用, 返回nil拒绝
+	codec                           Codec                                  // 子协议没有选择Codec的时候使用, 默认是JSONCodec
 	dialFunc                        func() (Dialer, error)
 	proxyFunc                       func(*http.Request) (*url.URL, error) //
 }
@@ -72,13 +96,10 @@ func (c *Config) defaultSetting() error {
 	c.windowsMultipleTimesPayloadSize = 1.0
 	c.delayWriteInitBufferSize = 8 * 1024
 	c.maxDelayWriteDuration = 10 * time.Millisecond
+	c.maxDelayWriteBytes = 64 * 1024
 	c.tcpNoDelay = true
 	c.parseMode = ParseModeWindows
 	// 对于text消息，默认不检查text是utf8字符
 	c.utf8Check = func(b []byte) bool { return true }
-
-	if c.dialFunc != nil && c.proxyFunc != nil {
-		return ErrDialFuncAndProxyFunc
-	}
 	return nil
 }
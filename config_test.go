@@ -59,10 +59,11 @@ func TestConfig_defaultSetting(t *testing.T) {
 		wantErr bool
 	}{
 		// TODO: Add test cases.
-		{name: "fail", fields: fields{
+		// dialFunc用来连接代理, 可以同时设置
+		{name: "dialFunc and proxyFunc", fields: fields{
 			dialFunc:  func() (Dialer, error) { return nil, nil },
 			proxyFunc: func(*http.Request) (*url.URL, error) { return nil, nil },
-		}, wantErr: true},
+		}, wantErr: false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -16,7 +16,7 @@ package quickws
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
@@ -24,6 +24,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,14 +47,7 @@ const (
 )
 
 // var _ net.Conn = (*Conn)(nil)
-
-// 延迟写, 基于次数和时间 合并数据写入, 实验功能
-type delayWrite struct {
-	delayBuf     *bytes.Buffer // 延迟写的缓冲区
-	delayTimeout *time.Timer   // 延迟写的定时器
-	delayErr     error         // TODO 原子操作
-	delayNum     int32         // 控制延迟写的数量
-}
+// 需要net.Conn的场景使用NetConnAdapter
 
 type Conn struct {
 	fr                   fixedreader.FixedReader            // 默认使用windows
@@ -69,12 +63,26 @@ type Conn struct {
 	fragmentFrameHeader  *frame.FrameHeader                 // 存放分段帧的头部
 	wmu                  sync.Mutex                         // 写的锁
 	*delayWrite                                             // 只有在需要的时候才初始化, 修改为指针是为了在海量连接的时候减少内存占用
+	sr                   *streamRead                        // 流式读取的状态, 只有在使用NextReader的时候才初始化
+	hb                   *heartbeat                         // 心跳, 只有配置了ping间隔的时候才初始化
+	closeHook            func(*Conn)                        // Close的时候调用, UpgradeServer用来删除记录的连接
+	elc                  *eventConn                         // event loop模式下的读状态
+	closeSent            int32                              // 已经主动发送过close包, 收到对端的close包时不再回复
+	subprotocol          string                             // 协商出来的子协议
+	extensions           []Extension                        // 协商出来的扩展
+	request              *http.Request                      // 服务端握手的请求
+	sess                 atomic.Pointer[session]            // 用户数据, 只有在使用的时候才初始化
+	reading              int32                              // 是否在ReadLoop里面, 是的话session在OnClose之后清空
+	rl                   *rateLimiter                       // 服务端读限速, 只有配置了才初始化
+	wq                   *writeQueue                        // 服务端发送队列, 只有配置了才初始化
 	deCtx                *deflate.DeCompressContextTakeover // 解压缩上下文
 	enCtx                *deflate.CompressContextTakeover   // 压缩上下文
 	closed               int32                              // 0: open, 1: closed
 	mu2                  sync.Mutex
 	onCloseOnce          myonce.MyOnce // 保证只调用一次OnClose函数
 	client               bool          // client(true) or server(flase)
+	writev               bool          // 底层连接支持writev, 大的payload不复制
+	muxConn              *MuxConn      // 多路复用层, 协商出MuxSubprotocol的时候才初始化
 }
 
 func setNoDelay(c net.Conn, noDelay bool) error {
@@ -99,11 +107,39 @@ func newConn(c net.Conn, client bool, conf *Config, fr fixedreader.FixedReader,
 		Config: conf,
 		fr:     fr,
 		br:     br,
+		writev: canWritev(c),
+	}
+
+	if conf.rateLimit != nil && !client {
+		wsCon.rl = newRateLimiter(conf.rateLimit)
+	}
+
+	if conf.writeQueueSize > 0 && !client {
+		wsCon.wq = newWriteQueue(conf.writeQueueSize, conf.writeQueuePolicy)
 	}
 
+	if conf.pingInterval > 0 {
+		wsCon.hb = &heartbeat{c: wsCon}
+	}
 	return wsCon, err
 }
 
+// 握手完成, Callback, pd, subprotocol这些字段都设置好之后调用
+func (c *Conn) ready() {
+	c.initMux()
+	if c.observer != nil {
+		c.observer.OnConnOpen(c)
+	}
+}
+
+// 开始读取之前调用, 心跳不会早于OnOpen
+func (c *Conn) open() {
+	if c.hb != nil {
+		c.hb.start()
+	}
+	c.OnOpen(c)
+}
+
 // 返回标准库的net.Conn
 func (c *Conn) NetConn() net.Conn {
 	return c.c
@@ -153,11 +189,13 @@ func (c *Conn) failRsv1(op opcode.Opcode) bool {
 }
 
 func (c *Conn) ReadLoop() (err error) {
-	c.OnOpen(c)
+	atomic.StoreInt32(&c.reading, 1)
+	c.open()
 
 	defer func() {
 		// c.OnClose(c, err)
 		c.Close()
+		c.clearSession()
 		if c.fr.IsInit() {
 			defer func() {
 				if err1 := c.fr.Release(); err1 != nil {
@@ -168,14 +206,16 @@ func (c *Conn) ReadLoop() (err error) {
 		}
 	}()
 
-	if c.br != nil {
-		newSize := int(1024 * c.bufioMultipleTimesPayloadSize)
-		if newSize > 0 && c.br.Size() != newSize {
-			// TODO sync.Pool管理
-			(*bufio2.Reader2)(unsafe.Pointer(c.br)).ResetBuf(make([]byte, newSize))
+	c.initBufioPayload()
+
+	// 回调实现了流式接口, 使用流式读取
+	if sc, ok := c.Callback.(StreamCallback); ok {
+		for {
+			err = c.readStreamMessage(sc)
+			if err != nil {
+				return err
+			}
 		}
-		// bufio 模式才会使用payload
-		c.bufioPayload = bytespool.GetBytes(1024 + enum.MaxFrameHeaderSize)
 	}
 
 	for {
@@ -186,7 +226,31 @@ func (c *Conn) ReadLoop() (err error) {
 	}
 }
 
+// bufio 模式才会使用payload
+func (c *Conn) initBufioPayload() {
+	if c.br == nil || c.bufioPayload != nil {
+		return
+	}
+
+	newSize := int(1024 * c.bufioMultipleTimesPayloadSize)
+	if newSize > 0 && c.br.Size() != newSize {
+		// TODO sync.Pool管理
+		(*bufio2.Reader2)(unsafe.Pointer(c.br)).ResetBuf(make([]byte, newSize))
+	}
+	c.bufioPayload = bytespool.GetBytes(1024 + enum.MaxFrameHeaderSize)
+}
+
+// 配置了WithServerEventLoop的服务端连接, 注册到event loop, 不会启动新的go程
+// 流式回调(StreamCallback)和注册失败的连接使用go程模式
 func (c *Conn) StartReadLoop() {
+	if c.eventLoop != nil && !c.client {
+		if _, ok := c.Callback.(StreamCallback); !ok {
+			if err := c.eventLoop.add(c); err == nil {
+				return
+			}
+		}
+	}
+
 	go func() {
 		_ = c.ReadLoop()
 	}()
@@ -221,6 +285,7 @@ func (c *Conn) readDataFromNet(headArray *[enum.MaxFrameHeaderSize]byte, bufioPa
 		c.writeAndMaybeOnClose(err)
 		return
 	}
+	c.observeFrameRead(&f.FrameHeader)
 
 	if c.readTimeout > 0 {
 		if err = c.c.SetReadDeadline(time.Time{}); err != nil {
@@ -240,16 +305,23 @@ func (c *Conn) readMessage() (err error) {
 		return err
 	}
 
+	return c.processFrame(f)
+}
+
+// 处理一个frame, 阻塞读和event loop共用
+func (c *Conn) processFrame(f frame.Frame2) (err error) {
+	if skip, err := c.rateLimitFrame(&f); skip || err != nil {
+		return err
+	}
+
 	op := f.Opcode
 	if c.fragmentFrameHeader != nil {
 		op = c.fragmentFrameHeader.Opcode
 	}
 
 	rsv1 := f.GetRsv1()
-	// 检查Rsv1 rsv2 Rfd, errsv3
-	if rsv1 && c.failRsv1(op) || f.GetRsv2() || f.GetRsv3() {
-		err = fmt.Errorf("%w:Rsv1(%t) Rsv2(%t) rsv2(%t) compression:%t", ErrRsv123, rsv1, f.GetRsv2(), f.GetRsv3(), c.Compression)
-		return c.writeErrAndOnClose(ProtocolError, err)
+	if err = c.checkRsv(&f.FrameHeader, op); err != nil {
+		return err
 	}
 
 	fin := f.GetFin()
@@ -339,72 +411,94 @@ func (c *Conn) readMessage() (err error) {
 	}
 
 	if f.Opcode == Close || f.Opcode == Ping || f.Opcode == Pong {
-		//  对方发的控制消息太大
-		if f.PayloadLen > maxControlFrameSize {
-			c.writeErrAndOnClose(ProtocolError, ErrMaxControlFrameSize)
-			return ErrMaxControlFrameSize
-		}
-		// Close, Ping, Pong 不能分片
-		if !fin {
-			c.writeErrAndOnClose(ProtocolError, ErrNOTBeFragmented)
-			return ErrNOTBeFragmented
-		}
+		return c.handleControlFrame(f)
+	}
+	// 检查Opcode
+	c.writeErrAndOnClose(ProtocolError, ErrOpcode)
+	return ErrOpcode
+}
 
-		if f.Opcode == Close {
-			if len(*f.Payload) == 0 {
-				c.writeErrAndOnClose(NormalClosure, &CloseErrMsg{Code: NormalClosure})
-				return nil
-			}
+// 检查Rsv1 rsv2 rsv3
+func (c *Conn) checkRsv(f *frame.FrameHeader, op Opcode) error {
+	rsv1 := f.GetRsv1()
+	if rsv1 && c.failRsv1(op) || f.GetRsv2() || f.GetRsv3() {
+		err := fmt.Errorf("%w:Rsv1(%t) Rsv2(%t) rsv2(%t) compression:%t", ErrRsv123, rsv1, f.GetRsv2(), f.GetRsv3(), c.Compression)
+		return c.writeErrAndOnClose(ProtocolError, err)
+	}
+	return nil
+}
 
-			if len(*f.Payload) < 2 {
-				return c.writeErrAndOnClose(ProtocolError, ErrClosePayloadTooSmall)
-			}
+// 处理控制帧 Close, Ping, Pong
+func (c *Conn) handleControlFrame(f frame.Frame2) (err error) {
+	//  对方发的控制消息太大
+	if f.PayloadLen > maxControlFrameSize {
+		c.writeErrAndOnClose(ProtocolError, ErrMaxControlFrameSize)
+		return ErrMaxControlFrameSize
+	}
+	// Close, Ping, Pong 不能分片
+	if !f.GetFin() {
+		c.writeErrAndOnClose(ProtocolError, ErrNOTBeFragmented)
+		return ErrNOTBeFragmented
+	}
 
-			if !c.utf8Check((*f.Payload)[2:]) {
-				return c.writeErrAndOnClose(ProtocolError, ErrTextNotUTF8)
-			}
+	if f.Opcode == Close {
+		if len(*f.Payload) == 0 {
+			c.writeErrAndOnClose(NormalClosure, &CloseErrMsg{Code: NormalClosure})
+			return nil
+		}
 
-			code := binary.BigEndian.Uint16(*f.Payload)
-			if !validCode(code) {
-				return c.writeErrAndOnClose(ProtocolError, ErrCloseValue)
-			}
+		if len(*f.Payload) < 2 {
+			return c.writeErrAndOnClose(ProtocolError, ErrClosePayloadTooSmall)
+		}
 
-			// 回敬一个close包
-			if err := c.WriteTimeout(Close, *f.Payload, 2*time.Second); err != nil {
-				return err
-			}
+		if !c.utf8Check((*f.Payload)[2:]) {
+			return c.writeErrAndOnClose(ProtocolError, ErrTextNotUTF8)
+		}
 
-			err = bytesToCloseErrMsg(*f.Payload)
-			c.onCloseOnce.Do(&c.mu2, func() {
-				c.Callback.OnClose(c, err)
-			})
-			return err
+		code := binary.BigEndian.Uint16(*f.Payload)
+		if !validCode(code) {
+			return c.writeErrAndOnClose(ProtocolError, ErrCloseValue)
 		}
 
-		if f.Opcode == Ping {
-			// 回一个pong包
-			if c.replyPing {
-				if err := c.WriteTimeout(Pong, *f.Payload, 2*time.Second); err != nil {
-					c.onCloseOnce.Do(&c.mu2, func() {
-						c.Callback.OnClose(c, err)
-					})
-					return err
-				}
-				c.Callback.OnMessage(c, f.Opcode, *f.Payload)
-				return
+		c.observeCloseCode(*f.Payload, true)
+		// 回敬一个close包, 如果是自己先发的close包, 这里收到的是对端的回复, 不需要再回
+		if atomic.LoadInt32(&c.closeSent) == 0 {
+			if err := c.WriteTimeout(Close, *f.Payload, 2*time.Second); err != nil {
+				return err
 			}
 		}
 
-		if f.Opcode == Pong && c.ignorePong {
+		err = bytesToCloseErrMsg(*f.Payload)
+		c.onCloseOnce.Do(&c.mu2, func() {
+			c.Callback.OnClose(c, err)
+		})
+		return err
+	}
+
+	if f.Opcode == Ping {
+		// 回一个pong包
+		if c.replyPing {
+			if err := c.WriteTimeout(Pong, *f.Payload, 2*time.Second); err != nil {
+				c.onCloseOnce.Do(&c.mu2, func() {
+					c.Callback.OnClose(c, err)
+				})
+				return err
+			}
+			c.Callback.OnMessage(c, f.Opcode, *f.Payload)
 			return
 		}
+	}
+
+	if f.Opcode == Pong && c.hb != nil {
+		c.hb.onPong()
+	}
 
-		c.Callback.OnMessage(c, f.Opcode, nil)
+	if f.Opcode == Pong && c.ignorePong {
 		return
 	}
-	// 检查Opcode
-	c.writeErrAndOnClose(ProtocolError, ErrOpcode)
-	return ErrOpcode
+
+	c.Callback.OnMessage(c, f.Opcode, nil)
+	return
 }
 
 func (c *Conn) WriteMessage(op Opcode, writeBuf []byte) (err error) {
@@ -418,6 +512,19 @@ func (c *Conn) WriteMessage(op Opcode, writeBuf []byte) (err error) {
 		}
 	}
 
+	// 配置了发送队列, 数据消息和close包异步写
+	if c.queued(op) {
+		return c.enqueueMessage(op, writeBuf)
+	}
+	return c.writeMessage(op, writeBuf)
+}
+
+// 压缩, 然后写到socket
+func (c *Conn) writeMessage(op Opcode, writeBuf []byte) (err error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
 	rsv1 := c.pd.Compression && (op == opcode.Text || op == opcode.Binary)
 	if rsv1 {
 		writeBufPtr, err := c.encoode(&writeBuf)
@@ -429,15 +536,15 @@ func (c *Conn) WriteMessage(op Opcode, writeBuf []byte) (err error) {
 		writeBuf = *writeBufPtr
 	}
 
-	// f.Opcode = op
-	// f.PayloadLen = int64(len(writeBuf))
-	maskValue := uint32(0)
-	if c.client {
-		maskValue = rand.Uint32()
+	if err = c.writeFrame(op, writeBuf, rsv1, rsv1); err != nil {
+		return err
 	}
 
-	var fw fixedwriter.FixedWriter
-	return frame.WriteFrame(&fw, c.c, writeBuf, true, rsv1, c.client, op, maskValue)
+	c.observeFrameWrite(op, true, len(writeBuf))
+	if op == opcode.Close {
+		c.observeCloseCode(writeBuf, false)
+	}
+	return nil
 }
 
 func (c *Conn) SetWriteDeadline(t time.Time) error {
@@ -450,7 +557,14 @@ func (c *Conn) WriteTimeout(op Opcode, data []byte, t time.Duration) (err error)
 	}
 
 	defer func() { _ = c.c.SetWriteDeadline(time.Time{}) }()
-	return c.WriteMessage(op, data)
+	if err = c.WriteMessage(op, data); err != nil || !c.queued(op) {
+		return err
+	}
+
+	// 放到了发送队列, 等队列写完, 超时对排队的消息也有效
+	ctx, cancel := context.WithTimeout(context.Background(), t)
+	defer cancel()
+	return c.Flush(ctx)
 }
 
 func (c *Conn) WriteCloseTimeout(sc StatusCode, t time.Duration) (err error) {
@@ -510,136 +624,62 @@ func (c *Conn) writeFragment(op Opcode, writeBuf []byte, maxFragment int /*单
 			if err := frame.WriteFrame(&fw, c.c, writeBuf[:maxFragment], false, rsv1, c.client, op, maskValue); err != nil {
 				return err
 			}
+			c.observeFrameWrite(op, false, maxFragment)
 			writeBuf = writeBuf[maxFragment:]
 			op = Continuation
 			continue
 		}
-		return frame.WriteFrame(&fw, c.c, writeBuf, true, rsv1, c.client, op, maskValue)
+		if err = frame.WriteFrame(&fw, c.c, writeBuf, true, rsv1, c.client, op, maskValue); err != nil {
+			return err
+		}
+		c.observeFrameWrite(op, true, len(writeBuf))
+		return nil
 	}
 	return nil
 }
 
 func (c *Conn) Close() (err error) {
+	first := false
 	c.once.Do(func() {
+		first = true
+		// 先从event loop里面删除, 再关闭fd, 防止poller读到复用的fd
+		if c.elc != nil {
+			c.eventLoop.unregister(c)
+		}
 		err = c.c.Close()
-		c.wmu.Lock()
-		if c.delayWrite != nil && c.delayTimeout != nil {
-			c.delayTimeout.Stop()
-			c.delayBuf = nil
+		if c.wq != nil {
+			c.wq.close()
+		}
+		if c.hb != nil {
+			c.hb.stop()
 		}
+		c.wmu.Lock()
+		c.closeDelayWrite()
 		c.wmu.Unlock()
 		atomic.StoreInt32(&c.closed, 1)
+		if c.closeHook != nil {
+			c.closeHook(c)
+		}
+		if c.observer != nil {
+			c.observer.OnConnClose(c)
+		}
+		// ReadLoop退出的时候再清空, OnClose里面还可以读取session
+		if atomic.LoadInt32(&c.reading) == 0 && c.elc == nil {
+			c.clearSession()
+		}
 	})
-	return
-}
 
-func (c *Conn) writerDelayBufSafe() {
-	c.wmu.Lock()
-	c.delayErr = c.writerDelayBufInner()
-	c.wmu.Unlock()
-}
-
-func (c *Conn) writerDelayBufInner() (err error) {
-	if c.delayBuf == nil || c.delayBuf.Len() == 0 || atomic.LoadInt32(&c.closed) == 1 {
-		return nil
-	}
-	_, err = c.c.Write(c.delayBuf.Bytes())
-	if c.delayTimeout != nil {
-		c.delayTimeout.Reset(c.maxDelayWriteDuration)
+	// event loop模式下已经从poller里面删除, 收不到fd关闭的事件, 在这里调用OnClose
+	// 放在once外面, OnClose里面还可以调用Close
+	if first && c.elc != nil {
+		c.onCloseOnce.Do(&c.mu2, func() {
+			c.Callback.OnClose(c, ErrClosed)
+		})
+		c.clearSession()
 	}
-	c.delayNum = 0
-	c.delayBuf.Reset()
 	return
 }
 
-// 对于流量场景这个版本推荐开启tcp delay 方法：WithClientTCPDelay() WithServerTCPDelay()
-
-// 该函数目前是研究性质的尝试
-// 延迟写消息, 对流量密集型的场景有用 或者开启tcp delay，
-// 1. 如果缓存的消息超过了多少条数
-// 2. 如果缓存的消费超过了多久的时间
-// 3. TODO: 最大缓存多少字节
-
-func (c *Conn) initDelayWrite() {
-	if c.delayWrite == nil {
-		c.wmu.Lock()
-		if c.delayWrite == nil {
-			c.delayWrite = &delayWrite{}
-		}
-		c.wmu.Unlock()
-	}
-}
 func (c *Conn) isClosed() bool {
 	return atomic.LoadInt32(&c.closed) == 1
 }
-
-func (c *Conn) WriteMessageDelay(op Opcode, writeBuf []byte) (err error) {
-	if c.isClosed() {
-		return ErrClosed
-	}
-
-	if op == opcode.Text {
-		if !c.utf8Check(writeBuf) {
-			return ErrTextNotUTF8
-		}
-	}
-
-	// 初始化对应的资源
-	c.initDelayWrite()
-	rsv1 := c.pd.Compression && (op == opcode.Text || op == opcode.Binary)
-	if rsv1 {
-		writeBufPtr, err := c.encoode(&writeBuf)
-		if err != nil {
-			return err
-		}
-		defer bytespool.PutBytes(writeBufPtr)
-		writeBuf = *writeBufPtr
-	}
-
-	c.wmu.Lock()
-	if c.isClosed() {
-		c.wmu.Unlock()
-		return nil
-	}
-	// 初始化缓存
-	if c.delayBuf == nil && c.delayWriteInitBufferSize > 0 {
-
-		// TODO: sync.Pool管理下, 如果size是1k 2k 3k
-		delayBuf := make([]byte, 0, c.delayWriteInitBufferSize)
-		c.delayBuf = bytes.NewBuffer(delayBuf)
-	}
-	// 初始化定时器
-	if c.delayTimeout == nil && c.maxDelayWriteDuration > 0 {
-		c.delayTimeout = time.AfterFunc(c.maxDelayWriteDuration, c.writerDelayBufSafe)
-	}
-	c.wmu.Unlock()
-
-	maskValue := uint32(0)
-	if c.client {
-		maskValue = rand.Uint32()
-	}
-	// 缓存的消息超过最大值, 则直接写入
-	c.wmu.Lock()
-	if c.isClosed() {
-		c.wmu.Unlock()
-		return
-	}
-	if c.delayNum+1 == c.maxDelayWriteNum {
-		err = frame.WriteFrameToBytes(c.delayBuf, writeBuf, true, rsv1, c.client, op, maskValue)
-		if err != nil {
-			c.wmu.Unlock()
-			return err
-		}
-		err = c.writerDelayBufInner()
-		c.wmu.Unlock()
-		return err
-	}
-
-	// 为了平衡生产者，消费者的速度，这里不使用协程
-	if c.delayBuf != nil {
-		err = frame.WriteFrameToBytes(c.delayBuf, writeBuf, true, rsv1, c.client, op, maskValue)
-	}
-	c.delayNum++ // 对记数计+1
-	c.wmu.Unlock()
-	return err
-}
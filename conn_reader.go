@@ -0,0 +1,333 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/antlabs/wsutil/frame"
+	"github.com/klauspost/compress/flate"
+)
+
+// 解压缩时需要补上的尾巴, 和wsutil/deflate里面的保持一致
+var inflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflate最大的窗口是32k
+const maxInflateDictSize = 1 << 15
+
+var inflateReaderPool = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// 流式读取的状态
+type streamRead struct {
+	reader *messageReader // 当前正在读取的消息
+	dict   []byte         // 上下文接管时, 保存最近32k解压之后的数据
+}
+
+func (s *streamRead) getDict() []byte {
+	if len(s.dict) > maxInflateDictSize {
+		return s.dict[len(s.dict)-maxInflateDictSize:]
+	}
+	return s.dict
+}
+
+func (s *streamRead) writeDict(p []byte) {
+	s.dict = append(s.dict, p...)
+	// 超过两倍窗口大小时, 把最近32k的数据挪到前面, 防止dict无限增长
+	if n := len(s.dict); n > 2*maxInflateDictSize {
+		copy(s.dict, s.dict[n-maxInflateDictSize:])
+		s.dict = s.dict[:maxInflateDictSize]
+	}
+}
+
+// 流式检查utf8, 一个字符可能被拆在两次Read里面
+type utf8Stream struct {
+	check func([]byte) bool
+	buf   [utf8.UTFMax]byte
+	n     int
+}
+
+// 返回末尾不完整的utf8字符的字节数
+func incompleteRuneTail(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+func (u *utf8Stream) write(p []byte) bool {
+	if u.n > 0 {
+		// 先补全上次剩下的字符
+		for len(p) > 0 && !utf8.FullRune(u.buf[:u.n]) {
+			u.buf[u.n] = p[0]
+			u.n++
+			p = p[1:]
+		}
+
+		if !utf8.FullRune(u.buf[:u.n]) {
+			return true
+		}
+
+		if !u.check(u.buf[:u.n]) {
+			return false
+		}
+		u.n = 0
+	}
+
+	tail := incompleteRuneTail(p)
+	if !u.check(p[:len(p)-tail]) {
+		return false
+	}
+	u.n = copy(u.buf[:], p[len(p)-tail:])
+	return true
+}
+
+// 消息结束的时候, 不能有残留的半个字符
+func (u *utf8Stream) finish() bool {
+	if u.n > 0 {
+		return u.check(u.buf[:u.n])
+	}
+	return true
+}
+
+// 读取原始的payload, 会跨越多个分段帧, 中间穿插的控制帧会被处理掉
+type frameReader struct {
+	c       *Conn
+	op      Opcode
+	payload []byte
+	fin     bool
+	err     error // 读取frame时的错误
+	read    int64 // 已经读取的原始payload大小, 压缩的时候是解压之前的大小
+}
+
+func (r *frameReader) Read(p []byte) (n int, err error) {
+	for len(r.payload) == 0 {
+		if r.fin {
+			return 0, io.EOF
+		}
+
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		f, err := r.c.nextFrame()
+		if err == nil {
+			err = r.c.checkRsv(&f.FrameHeader, r.op)
+		}
+
+		if err == nil && f.Opcode != Continuation {
+			r.c.writeErrAndOnClose(ProtocolError, ErrFrameOpcode)
+			err = ErrFrameOpcode
+		}
+
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+
+		r.payload = *f.Payload
+		r.fin = f.GetFin()
+	}
+
+	n = copy(p, r.payload)
+	r.payload = r.payload[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+// NextReader返回的io.Reader
+type messageReader struct {
+	c        *Conn
+	op       Opcode
+	r        io.Reader
+	fr       frameReader
+	inflate  io.ReadCloser // 解压缩, 没有压缩的时候为nil
+	total    int64         // 已经读取的数据, 解压之后的大小
+	utf8     utf8Stream
+	takeover bool // 上下文接管
+	err      error
+}
+
+func (m *messageReader) Read(p []byte) (n int, err error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	c := m.c
+	n, err = m.r.Read(p)
+	if n > 0 {
+		m.total += int64(n)
+		if c.readMaxMessage > 0 && m.total > c.readMaxMessage {
+			c.writeErrAndOnClose(TooBigMessage, TooBigMessage)
+			m.err = TooBigMessage
+			return 0, m.err
+		}
+
+		if m.op == Text && !m.utf8.write(p[:n]) {
+			c.writeErrAndOnClose(NotConsistentMessageType, ErrTextNotUTF8)
+			m.err = ErrTextNotUTF8
+			return 0, m.err
+		}
+
+		if m.takeover {
+			c.sr.writeDict(p[:n])
+		}
+	}
+
+	if err == io.EOF {
+		if m.op == Text && !m.utf8.finish() {
+			c.writeErrAndOnClose(NotConsistentMessageType, ErrTextNotUTF8)
+			m.err = ErrTextNotUTF8
+			return 0, m.err
+		}
+
+		if m.inflate != nil {
+			inflateReaderPool.Put(m.inflate)
+			m.inflate = nil
+			if c.observer != nil {
+				c.observer.OnDecompress(c, int(m.fr.read), int(m.total))
+			}
+		}
+	} else if err != nil && m.inflate != nil && m.fr.err == nil {
+		// 解压缩出错, 读取frame的错误在frameReader里面已经处理过了
+		c.writeErrAndOnClose(ProtocolError, err)
+	}
+
+	if err != nil {
+		m.err = err
+	}
+	return n, err
+}
+
+func (c *Conn) initStreamRead() {
+	if c.sr == nil {
+		c.sr = &streamRead{}
+	}
+}
+
+// 读取下一个frame, 控制帧在这里处理
+func (c *Conn) nextFrame() (f frame.Frame2, err error) {
+	for {
+		f, err = c.readDataFromNet(&c.readHeadArray, c.bufioPayload)
+		if err != nil {
+			return f, err
+		}
+
+		skip, err := c.rateLimitFrame(&f)
+		if err != nil {
+			return f, err
+		}
+		if skip {
+			continue
+		}
+
+		if !f.Opcode.IsControl() {
+			return f, nil
+		}
+
+		if err = c.checkRsv(&f.FrameHeader, f.Opcode); err != nil {
+			return f, err
+		}
+
+		if err = c.handleControlFrame(f); err != nil {
+			return f, err
+		}
+
+		// 收到一个空的close包
+		if f.Opcode == Close {
+			return f, &CloseErrMsg{Code: NormalClosure}
+		}
+	}
+}
+
+// NextReader 返回下一个text或者binary消息的io.Reader, 数据一边从网络读取, 一边交给调用者,
+// 不会把整个消息缓存在内存中. 开启解压缩时, 读到的是解压之后的数据
+// 中间穿插的控制帧(ping, pong, close)和ReadLoop中的处理方式一样, 会通过Callback.OnMessage回调
+// 再次调用NextReader时, 上一个消息没有读完的数据会被丢弃
+// 和ReadLoop只能二选一, 不能同时使用
+func (c *Conn) NextReader() (op Opcode, r io.Reader, err error) {
+	if c.isClosed() {
+		return 0, nil, ErrClosed
+	}
+
+	c.initBufioPayload()
+	c.initStreamRead()
+
+	// 上一个消息没有读完的数据直接丢弃
+	if c.sr.reader != nil {
+		if _, err = io.Copy(io.Discard, c.sr.reader); err != nil {
+			return 0, nil, err
+		}
+		c.sr.reader = nil
+	}
+
+	f, err := c.nextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if f.Opcode != Text && f.Opcode != Binary {
+		c.writeErrAndOnClose(ProtocolError, ErrOpcode)
+		return 0, nil, ErrOpcode
+	}
+
+	if err = c.checkRsv(&f.FrameHeader, f.Opcode); err != nil {
+		return 0, nil, err
+	}
+
+	m := &messageReader{c: c, op: f.Opcode}
+	m.utf8.check = c.utf8Check
+	m.fr = frameReader{c: c, op: f.Opcode, payload: *f.Payload, fin: f.GetFin()}
+	m.r = &m.fr
+	if f.GetRsv1() && c.pd.Decompression {
+		// 不管谁的上下文接管, 都保存字典, 对端没有使用上下文接管时, 字典不会被引用
+		m.takeover = c.pd.ServerContextTakeover || c.pd.ClientContextTakeover
+		var dict []byte
+		if m.takeover {
+			dict = c.sr.getDict()
+		}
+
+		inflate := inflateReaderPool.Get().(io.ReadCloser)
+		if err = inflate.(flate.Resetter).Reset(io.MultiReader(&m.fr, bytes.NewReader(inflateTail)), dict); err != nil {
+			return 0, nil, err
+		}
+		m.inflate = inflate
+		m.r = inflate
+	}
+
+	c.sr.reader = m
+	return f.Opcode, m, nil
+}
+
+// 流式读取一个消息, 交给StreamCallback
+func (c *Conn) readStreamMessage(sc StreamCallback) error {
+	op, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+
+	sc.OnMessageReader(c, op, r)
+	// 回调里面没有读完的数据, 下次调用NextReader时丢弃
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func Test_NextReader(t *testing.T) {
+	t.Run("fragment", func(t *testing.T) {
+		data := make(chan []byte, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			op, rd, err := c.NextReader()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if op != Binary {
+				t.Errorf("op:%v, need:%v", op, Binary)
+			}
+			all, err := io.ReadAll(rd)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data <- all
+		}))
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		if err = con.writeFragment(Binary, testBinaryMessage64kb, 1000); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case d := <-data:
+			if !bytes.Equal(d, testBinaryMessage64kb) {
+				t.Errorf("got %d bytes, need %d bytes", len(d), len(testBinaryMessage64kb))
+			}
+		case <-time.After(time.Second):
+			t.Error("timeout")
+		}
+	})
+
+	t.Run("decompression-context-takeover", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r,
+				WithServerDecompressAndCompress(),
+				WithServerContextTakeover(),
+				// 服务端没有配置客户端上下文接管的选项
+				func(o *ConnOption) { o.ClientContextTakeover = true },
+				WithServerBufioParseMode(),
+				WithServerOnMessageReaderFunc(func(c *Conn, op Opcode, rd io.Reader) {
+					all, err := io.ReadAll(rd)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if err := c.WriteMessage(op, all); err != nil {
+						t.Error(err)
+					}
+				}))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		data := make(chan string, 3)
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url,
+			WithClientDecompressAndCompress(),
+			WithClientContextTakeover(),
+			WithClientMaxWindowsBits(10),
+			WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				data <- string(payload)
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+		con.StartReadLoop()
+
+		need := []string{strings.Repeat("hello", 100), strings.Repeat("hello", 200), string(testTextMessage64kb)}
+		for _, s := range need {
+			if err = con.writeFragment(Text, []byte(s), 100); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, s := range need {
+			select {
+			case d := <-data:
+				if d != s {
+					t.Errorf("got %d bytes, need %d bytes", len(d), len(s))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+		}
+	})
+
+	t.Run("decompression-observer", func(t *testing.T) {
+		serverMetrics := NewMetrics()
+		clientMetrics := NewMetrics()
+		done := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r,
+				WithServerObserver(serverMetrics),
+				WithServerDecompressAndCompress(),
+				WithServerOnMessageReaderFunc(func(c *Conn, op Opcode, rd io.Reader) {
+					if _, err := io.ReadAll(rd); err != nil {
+						t.Error(err)
+					}
+					close(done)
+				}))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url, WithClientObserver(clientMetrics), WithClientDecompressAndCompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		data := []byte(strings.Repeat("hello", 200))
+		if err = con.writeFragment(Text, data, 10); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+
+		st := serverMetrics.Total()
+		if st.DecompressOut != uint64(len(data)) {
+			t.Errorf("got %d decompressed bytes, need %d", st.DecompressOut, len(data))
+		}
+		if need := clientMetrics.Total().CompressOut; st.DecompressIn != need {
+			t.Errorf("got %d compressed bytes, need %d", st.DecompressIn, need)
+		}
+	})
+
+	t.Run("read-max-message", func(t *testing.T) {
+		errChan := make(chan error, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r, WithServerReadMaxMessage(1024))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+
+			_, rd, err := c.NextReader()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, err = io.ReadAll(rd)
+			errChan <- err
+		}))
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		if err = con.writeFragment(Binary, testBinaryMessage64kb, 512); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-errChan:
+			if !errors.Is(err, TooBigMessage) {
+				t.Errorf("got %v, need %v", err, TooBigMessage)
+			}
+		case <-time.After(time.Second):
+			t.Error("timeout")
+		}
+	})
+}
+
+func Test_utf8Stream(t *testing.T) {
+	t.Run("split", func(t *testing.T) {
+		s := []byte("中文a中")
+		for i := 0; i <= len(s); i++ {
+			u := utf8Stream{check: utf8.Valid}
+			if !u.write(s[:i]) || !u.write(s[i:]) || !u.finish() {
+				t.Errorf("split at %d: need valid", i)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		u := utf8Stream{check: utf8.Valid}
+		if u.write([]byte{'a', 0xff}) {
+			t.Error("need invalid")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		u := utf8Stream{check: utf8.Valid}
+		if !u.write([]byte("中")[:2]) {
+			t.Error("need valid")
+		}
+		if u.finish() {
+			t.Error("need invalid")
+		}
+	})
+}
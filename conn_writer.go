@@ -0,0 +1,188 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"io"
+	"math/rand"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/fixedwriter"
+	"github.com/antlabs/wsutil/frame"
+)
+
+// 流式写入时, 默认单个分段的大小
+const defaultWriteFragmentSize = 4 * 1024
+
+// sync flush的尾巴, 压缩时每个分段都是以sync flush结束, 只有最后一个分段需要去掉
+var deflateSyncTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// NextWriter返回的io.WriteCloser
+type messageWriter struct {
+	c        *Conn
+	op       Opcode  // 第一个分段是Text或者Binary, 后面的是Continuation
+	buf      *[]byte // 缓存还没有发送的数据
+	compress bool    // 是否压缩, 只有第一个分段设置rsv1
+	first    bool
+	utf8     utf8Stream
+	closed   bool
+	err      error
+}
+
+func (c *Conn) writeFragmentSizeOrDefault() int {
+	if c.writeFragmentSize > 0 {
+		return c.writeFragmentSize
+	}
+	return defaultWriteFragmentSize
+}
+
+// NextWriter 返回一个io.WriteCloser, 写入的数据缓存满一个分段的大小(WithServerWriteFragmentSize, WithClientWriteFragmentSize)就会发送出去,
+// Close的时候发送最后一个分段. 开启压缩时, 每个分段单独压缩, 只有第一个分段设置rsv1
+// 每个分段都是持有写锁发送的, 分段之间可以穿插控制帧(ping, pong, close)
+// 在Close之前, 不能调用WriteMessage等函数写其他的text和binary消息
+// 发送第一个分段之前, 会等发送队列(WithServerWriteQueue)写完, 并且写出WriteMessageDelay缓存的数据
+func (c *Conn) NextWriter(op Opcode) (io.WriteCloser, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	if op != Text && op != Binary {
+		return nil, ErrOpcode
+	}
+
+	size := c.writeFragmentSizeOrDefault()
+	buf := bytespool.GetBytes(size)
+	*buf = (*buf)[:0]
+	w := &messageWriter{
+		c:        c,
+		op:       op,
+		buf:      buf,
+		compress: c.pd.Compression,
+		first:    true,
+	}
+	w.utf8.check = c.utf8Check
+	return w, nil
+}
+
+func (w *messageWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.closed {
+		return 0, ErrWriteClosed
+	}
+
+	if w.op == Text && !w.utf8.write(p) {
+		w.err = ErrTextNotUTF8
+		return 0, w.err
+	}
+
+	size := w.c.writeFragmentSizeOrDefault()
+	for len(p) > 0 {
+		buf := *w.buf
+		m := copy(buf[len(buf):size], p)
+		*w.buf = buf[:len(buf)+m]
+		n += m
+		p = p[m:]
+
+		if len(*w.buf) == size {
+			if err = w.flushFrame(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// 发送一个分段
+func (w *messageWriter) flushFrame(fin bool) (err error) {
+	c := w.c
+	payload := *w.buf
+	if w.compress {
+		payloadPtr, err := c.encoode(&payload)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		defer bytespool.PutBytes(payloadPtr)
+
+		// 不是最后一个分段, 把sync flush的尾巴加回去, 保证多个分段拼起来还是一个合法的deflate流
+		if !fin {
+			*payloadPtr = append(*payloadPtr, deflateSyncTail...)
+		}
+		payload = *payloadPtr
+	}
+
+	maskValue := uint32(0)
+	if c.client {
+		maskValue = rand.Uint32()
+	}
+
+	// 第一个分段之前, 等发送队列里面的消息写完, 保证消息的顺序
+	if w.first && c.wq != nil {
+		if err = c.Flush(context.Background()); err != nil {
+			w.err = err
+			return err
+		}
+	}
+
+	c.wmu.Lock()
+	if c.isClosed() {
+		c.wmu.Unlock()
+		w.err = ErrClosed
+		return w.err
+	}
+	// 延迟写缓冲区里面的数据先写出去
+	if err = c.flushDelayBuf(); err == nil {
+		var fw fixedwriter.FixedWriter
+		err = frame.WriteFrame(&fw, c.c, payload, fin, w.compress && w.first, c.client, w.op, maskValue)
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	c.observeFrameWrite(w.op, fin, len(payload))
+
+	w.first = false
+	w.op = Continuation
+	*w.buf = (*w.buf)[:0]
+	return nil
+}
+
+// 发送最后一个分段
+func (w *messageWriter) Close() (err error) {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	defer func() {
+		bytespool.PutBytes(w.buf)
+		w.buf = nil
+	}()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.op == Text && !w.utf8.finish() {
+		w.err = ErrTextNotUTF8
+		return w.err
+	}
+
+	return w.flushFrame(true)
+}
@@ -0,0 +1,204 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 把数据按chunk大小分多次写入
+func writeByChunk(w io.WriteCloser, data []byte, chunk int) error {
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return w.Close()
+}
+
+func Test_NextWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		server []ServerOption
+		client []ClientOption
+	}{
+		{name: "no-compression"},
+		{
+			name:   "compression",
+			server: []ServerOption{WithServerDecompressAndCompress()},
+			client: []ClientOption{WithClientDecompressAndCompress()},
+		},
+		{
+			name: "compression-context-takeover",
+			server: []ServerOption{
+				WithServerDecompressAndCompress(),
+				// 服务端没有配置客户端上下文接管的选项
+				func(o *ConnOption) { o.ClientContextTakeover = true },
+				WithServerOnMessageReaderFunc(func(c *Conn, op Opcode, r io.Reader) {
+					all, err := io.ReadAll(r)
+					if err != nil {
+						return
+					}
+					_ = c.WriteMessage(op, all)
+				}),
+			},
+			client: []ClientOption{WithClientDecompressAndCompress(), WithClientContextTakeover(), WithClientMaxWindowsBits(10)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]ServerOption{WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				_ = c.WriteMessage(op, payload)
+			})}, tc.server...)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Upgrade(w, r, opts...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = c.ReadLoop()
+			}))
+			defer ts.Close()
+
+			data := make(chan []byte, 2)
+			url := HTTPToWS(ts.URL)
+			con, err := Dial(url, append([]ClientOption{
+				WithClientWriteFragmentSize(100),
+				WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+					data <- append([]byte(nil), payload...)
+				}),
+			}, tc.client...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer con.Close()
+			con.StartReadLoop()
+
+			need := [][]byte{testTextMessage64kb, []byte("hello world")}
+			for _, msg := range need {
+				w, err := con.NextWriter(Text)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = writeByChunk(w, msg, 333); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, msg := range need {
+				select {
+				case d := <-data:
+					if !bytes.Equal(d, msg) {
+						t.Errorf("got %d bytes, need %d bytes", len(d), len(msg))
+					}
+				case <-time.After(time.Second):
+					t.Fatal("timeout")
+				}
+			}
+		})
+	}
+
+	t.Run("text-not-utf8", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url, WithClientEnableUTF8Check())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		w, err := con.NextWriter(Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte("中")[:2]); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); !errors.Is(err, ErrTextNotUTF8) {
+			t.Errorf("got %v, need %v", err, ErrTextNotUTF8)
+		}
+	})
+
+	t.Run("control-opcode", func(t *testing.T) {
+		var c Conn
+		if _, err := c.NextWriter(Ping); !errors.Is(err, ErrOpcode) {
+			t.Errorf("got %v, need %v", err, ErrOpcode)
+		}
+	})
+
+	t.Run("write queue order", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 4, WriteQueueBlock, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2")
+
+		done := make(chan error, 1)
+		go func() {
+			w, err := c.NextWriter(Text)
+			if err == nil {
+				_, _ = w.Write([]byte("m3"))
+				err = w.Close()
+			}
+			done <- err
+		}()
+		close(g.gate)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2,m3" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("delay write order", func(t *testing.T) {
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c := newDelayWriteConn(t, g, make(chan error, 1),
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(time.Hour))
+
+		if err := c.WriteMessageDelay(Text, []byte("m1")); err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.NextWriter(Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte("m2"))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2" {
+			t.Fatalf("got %s", got)
+		}
+	})
+}
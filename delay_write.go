@@ -0,0 +1,230 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/frame"
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// 延迟写, 基于次数, 字节数和时间 合并数据写入
+// 对于流量场景也可以开启tcp delay 方法：WithClientTCPDelay() WithServerTCPDelay()
+type delayWrite struct {
+	delayBuf     *bytes.Buffer // 延迟写的缓冲区, 有数据的时候才从pool里面拿, 写完还回去
+	delayTimeout *time.Timer   // 延迟写的定时器, 缓冲区从空变成非空的时候启动
+	delayErr     error         // 定时器go程写socket的错误, 之后的WriteMessageDelay和FlushDelay都返回这个错误
+	delayNum     int32         // 控制延迟写的数量
+}
+
+// 延迟写的缓冲区按容量分级放到pool里面, 1k, 2k, 4k ... 1M
+// 超过1M的缓冲区不放回pool, 交给gc
+const (
+	minDelayBufShift = 10
+	maxDelayBufShift = 20
+)
+
+var delayBufPools [maxDelayBufShift - minDelayBufShift + 1]sync.Pool
+
+// 容量不小于size的最小等级
+func delayBufIndex(size int) int {
+	i := 0
+	for i < len(delayBufPools)-1 && 1<<(minDelayBufShift+i) < size {
+		i++
+	}
+	return i
+}
+
+func getDelayBuf(size int) *bytes.Buffer {
+	i := delayBufIndex(size)
+	if v := delayBufPools[i].Get(); v != nil {
+		return v.(*bytes.Buffer)
+	}
+
+	n := 1 << (minDelayBufShift + i)
+	if size > n {
+		n = size
+	}
+	return bytes.NewBuffer(make([]byte, 0, n))
+}
+
+func putDelayBuf(b *bytes.Buffer) {
+	n := b.Cap()
+	if n < 1<<minDelayBufShift || n > 1<<maxDelayBufShift {
+		return
+	}
+
+	// 放到容量不大于n的最大等级, 保证从这个等级拿出来的缓冲区都够用
+	b.Reset()
+	delayBufPools[bits.Len(uint(n))-1-minDelayBufShift].Put(b)
+}
+
+func (c *Conn) initDelayWrite() {
+	if c.delayWrite == nil {
+		c.wmu.Lock()
+		if c.delayWrite == nil {
+			c.delayWrite = &delayWrite{}
+		}
+		c.wmu.Unlock()
+	}
+}
+
+// 定时器的回调, 写失败的时候调用OnClose并关闭连接
+func (c *Conn) writerDelayBufSafe() {
+	c.wmu.Lock()
+	err := c.flushDelayBuf()
+	if err != nil && c.delayErr == nil {
+		c.delayErr = err
+	}
+	c.wmu.Unlock()
+
+	if err != nil {
+		c.onCloseOnce.Do(&c.mu2, func() {
+			c.Callback.OnClose(c, err)
+		})
+		c.Close()
+	}
+}
+
+// 把缓冲区的数据写到socket, 缓冲区还给pool, 需要持有wmu
+func (c *Conn) flushDelayBuf() (err error) {
+	if c.delayWrite == nil || c.delayBuf == nil {
+		return nil
+	}
+
+	if c.delayTimeout != nil {
+		c.delayTimeout.Stop()
+	}
+	if c.delayBuf.Len() > 0 && !c.isClosed() {
+		_, err = c.c.Write(c.delayBuf.Bytes())
+	}
+	c.delayNum = 0
+	putDelayBuf(c.delayBuf)
+	c.delayBuf = nil
+	return err
+}
+
+// 连接关闭的时候丢弃没有写出去的数据, 需要持有wmu
+func (c *Conn) closeDelayWrite() {
+	if c.delayWrite == nil {
+		return
+	}
+
+	if c.delayTimeout != nil {
+		c.delayTimeout.Stop()
+	}
+	if c.delayBuf != nil {
+		putDelayBuf(c.delayBuf)
+		c.delayBuf = nil
+	}
+	c.delayNum = 0
+}
+
+// 定时器写失败的错误优先, 其次是ErrClosed, 需要持有wmu
+func (c *Conn) delayWriteErr() error {
+	if c.delayWrite != nil && c.delayErr != nil {
+		return c.delayErr
+	}
+	if c.isClosed() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// 延迟写消息, 对流量密集型的场景有用, 满足下面任意一个条件就写到socket
+// 1. 缓存的消息达到WithServerMaxDelayWriteNum配置的条数
+// 2. 缓存的字节数达到WithServerMaxDelayWriteBytes配置的大小
+// 3. 第一条消息缓存之后超过了WithServerMaxDelayWriteDuration配置的时间
+// 定时器写socket的错误会通过OnClose通知, 并且在下一次调用的时候返回
+func (c *Conn) WriteMessageDelay(op Opcode, writeBuf []byte) (err error) {
+	if c.isClosed() {
+		c.wmu.Lock()
+		err = c.delayWriteErr()
+		c.wmu.Unlock()
+		return err
+	}
+
+	if op == opcode.Text {
+		if !c.utf8Check(writeBuf) {
+			return ErrTextNotUTF8
+		}
+	}
+
+	// 初始化对应的资源
+	c.initDelayWrite()
+	rsv1 := c.pd.Compression && (op == opcode.Text || op == opcode.Binary)
+	if rsv1 {
+		writeBufPtr, err := c.encoode(&writeBuf)
+		if err != nil {
+			return err
+		}
+		defer bytespool.PutBytes(writeBufPtr)
+		writeBuf = *writeBufPtr
+	}
+
+	maskValue := uint32(0)
+	if c.client {
+		maskValue = rand.Uint32()
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err = c.delayWriteErr(); err != nil {
+		return err
+	}
+
+	// 缓冲区从空变成非空, 从pool里面拿缓冲区, 启动定时器
+	if c.delayBuf == nil {
+		c.delayBuf = getDelayBuf(int(c.delayWriteInitBufferSize))
+		if c.maxDelayWriteDuration > 0 {
+			if c.delayTimeout == nil {
+				c.delayTimeout = time.AfterFunc(c.maxDelayWriteDuration, c.writerDelayBufSafe)
+			} else {
+				c.delayTimeout.Reset(c.maxDelayWriteDuration)
+			}
+		}
+	}
+
+	// 为了平衡生产者，消费者的速度，这里不使用协程
+	if err = frame.WriteFrameToBytes(c.delayBuf, writeBuf, true, rsv1, c.client, op, maskValue); err != nil {
+		return err
+	}
+	c.observeFrameWrite(op, true, len(writeBuf))
+	c.delayNum++ // 对记数计+1
+
+	// 缓存的消息个数或者字节数超过最大值, 则直接写入
+	if c.maxDelayWriteNum > 0 && c.delayNum >= c.maxDelayWriteNum ||
+		c.maxDelayWriteBytes > 0 && c.delayBuf.Len() >= int(c.maxDelayWriteBytes) {
+		return c.flushDelayBuf()
+	}
+	return nil
+}
+
+// 立即把延迟写缓冲区里面的数据写到socket, 请求/响应的场景可以在写完响应之后调用
+// 没有使用过WriteMessageDelay的时候直接返回
+func (c *Conn) FlushDelay() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.delayWriteErr(); err != nil {
+		return err
+	}
+	return c.flushDelayBuf()
+}
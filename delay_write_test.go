@@ -0,0 +1,180 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antlabs/wsutil/fixedreader"
+)
+
+var errBrokenPipe = errors.New("broken pipe")
+
+// 写总是失败的连接
+type brokenConn struct {
+	net.Conn
+}
+
+func (b *brokenConn) Write(p []byte) (int, error)        { return 0, errBrokenPipe }
+func (b *brokenConn) Close() error                       { return nil }
+func (b *brokenConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newDelayWriteConn(t *testing.T, nc net.Conn, closed chan error, opts ...ServerOption) *Conn {
+	var conf ConnOption
+	if err := conf.defaultSetting(); err != nil {
+		t.Fatal(err)
+	}
+	WithServerOnCloseFunc(func(c *Conn, err error) { closed <- err })(&conf)
+	for _, o := range opts {
+		o(&conf)
+	}
+
+	c, err := newConn(nc, false, &conf.Config, fixedreader.FixedReader{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Callback = conf.cb
+	return c
+}
+
+func Test_DelayWrite(t *testing.T) {
+	t.Run("max bytes", func(t *testing.T) {
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c := newDelayWriteConn(t, g, make(chan error, 1),
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(time.Hour),
+			WithServerMaxDelayWriteBytes(8))
+
+		if err := c.WriteMessageDelay(Text, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if got := g.messages(); len(got) != 0 {
+			t.Fatalf("flushed too early: %v", got)
+		}
+		// 2+1+2+5 >= 8
+		if err := c.WriteMessageDelay(Text, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "a,hello" {
+			t.Fatalf("got %s", got)
+		}
+		if c.delayBuf != nil {
+			t.Fatal("delayBuf not returned to pool")
+		}
+	})
+
+	t.Run("FlushDelay", func(t *testing.T) {
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c := newDelayWriteConn(t, g, make(chan error, 1),
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(time.Hour))
+
+		if err := c.FlushDelay(); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []string{"m1", "m2"} {
+			if err := c.WriteMessageDelay(Text, []byte(m)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.FlushDelay(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2" {
+			t.Fatalf("got %s", got)
+		}
+
+		c.Close()
+		if err := c.FlushDelay(); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("timer", func(t *testing.T) {
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c := newDelayWriteConn(t, g, make(chan error, 1),
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(5*time.Millisecond))
+
+		// 每次缓冲区变成非空都要重新启动定时器
+		for _, m := range []string{"m1", "m2"} {
+			if err := c.WriteMessageDelay(Text, []byte(m)); err != nil {
+				t.Fatal(err)
+			}
+			deadline := time.Now().Add(time.Second)
+			for !strings.HasSuffix(strings.Join(g.messages(), ","), m) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s not flushed by timer", m)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	})
+
+	t.Run("timer error", func(t *testing.T) {
+		closed := make(chan error, 1)
+		c := newDelayWriteConn(t, &brokenConn{}, closed,
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(time.Millisecond))
+
+		if err := c.WriteMessageDelay(Text, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-closed:
+			if !errors.Is(err, errBrokenPipe) {
+				t.Fatalf("OnClose got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("OnClose not called")
+		}
+
+		if err := c.WriteMessageDelay(Text, []byte("hello")); !errors.Is(err, errBrokenPipe) {
+			t.Fatalf("WriteMessageDelay got %v", err)
+		}
+		if err := c.FlushDelay(); !errors.Is(err, errBrokenPipe) {
+			t.Fatalf("FlushDelay got %v", err)
+		}
+	})
+}
+
+func Test_DelayBufPool(t *testing.T) {
+	for _, tc := range []struct{ size, wantCap int }{
+		{0, 1 << 10},
+		{1 << 10, 1 << 10},
+		{1<<10 + 1, 1 << 11},
+		{8 * 1024, 8 * 1024},
+	} {
+		b := getDelayBuf(tc.size)
+		if b.Cap() < tc.wantCap {
+			t.Fatalf("size %d: cap %d < %d", tc.size, b.Cap(), tc.wantCap)
+		}
+		putDelayBuf(b)
+	}
+
+	// 超过最大等级的缓冲区不放回pool
+	b := getDelayBuf(2 << maxDelayBufShift)
+	if b.Cap() < 2<<maxDelayBufShift {
+		t.Fatalf("cap %d", b.Cap())
+	}
+	putDelayBuf(b)
+}
@@ -42,6 +42,64 @@ var (
 	ErrCloseValue           = errors.New("error:close value is wrong") // close值不对
 	ErrEmptyClose           = errors.New("error:close value is empty") // close的值是空的
 	ErrWriteClosed          = errors.New("write close")
+	ErrPongTimeout          = errors.New("error:wait pong timeout")
+
+	// 自动重连的客户端
+	ErrDisconnected       = errors.New("error:disconnected, reconnecting")
+	ErrReconnectQueueFull = errors.New("error:reconnect write queue is full")
+
+	// UpgradeServer正在关闭, 不再接受新的连接
+	ErrServerShutdown = errors.New("error:server is shutting down")
+	ErrNotTrackConns  = errors.New("error:shutdown needs WithServerTrackConns")
+
+	// 握手准入
+	ErrBadOrigin         = errors.New("error:origin not allowed")
+	ErrHandshakeRejected = errors.New("error:handshake rejected by hook")
+
+	// 服务端配置的子协议和客户端的都不匹配
+	ErrNoMatchingSubprotocol = errors.New("error:no matching subprotocol")
+
+	// 客户端检查握手协商的结果
+	ErrSubprotocolNotOffered = errors.New("error:server selected a subprotocol that the client did not offer")
+	ErrExtensionNotOffered   = errors.New("error:server responded with an extension that the client did not request")
+
+	// 自定义的101响应头
+	ErrProtectedResponseHeader = errors.New("error:protocol header cannot be overridden in response header")
+	ErrInvalidResponseHeader   = errors.New("error:response header value contains CR or LF")
+
+	// RFC 8441
+	ErrProtocolFieldValue          = errors.New("error::protocol must be websocket")
+	ErrExtendedConnectNotSupported = errors.New("error:server does not support HTTP/2 extended CONNECT")
+
+	// event loop
+	ErrEventLoopNotSupported = errors.New("error:event loop is not supported on this platform or connection")
+	ErrEventLoopClosed       = errors.New("error:event loop is closed")
+
+	// proxy url的scheme不是http, https, socks5, socks5h
+	ErrUnsupportedProxyScheme = errors.New("error:unsupported proxy scheme")
+	// 代理拒绝了CONNECT请求, 详细信息在*ProxyError里面
+	ErrProxyConnect      = errors.New("error:proxy CONNECT failed")
+	ErrProxyAuthRequired = errors.New("error:proxy authentication required")
+
+	// 多路复用
+	ErrMuxNotNegotiated = errors.New("error:server did not select the mux subprotocol")
+	ErrMuxProtocol      = errors.New("error:invalid mux frame")
+	ErrChannelClosed    = errors.New("error:channel is closed")
+	ErrChannelRefused   = errors.New("error:channel refused by peer")
+	ErrMuxPoolClosed    = errors.New("error:mux pool is closed")
+	ErrMuxIDExhausted   = errors.New("error:mux channel ids exhausted")
+
+	// Codec解码消息失败
+	ErrDecodeMessage = errors.New("error:decode message failed")
+
+	// 超过WithServerRateLimit的限速
+	ErrRateLimited = errors.New("error:rate limit exceeded")
+
+	// 连接的发送队列满了
+	ErrWriteQueueFull = errors.New("error:write queue is full")
+
+	// 广播的时候发送队列满了
+	ErrSlowConsumer = errors.New("error:slow consumer, send queue is full")
 )
 
 var (
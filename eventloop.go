@@ -0,0 +1,299 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/enum"
+	"github.com/antlabs/wsutil/frame"
+)
+
+type eventLoopConf struct {
+	pollers       int  // poller的个数
+	workers       int  // 执行回调的go程个数
+	queueSize     int  // 待处理连接队列的大小
+	edgeTriggered bool // 是否使用边缘触发
+}
+
+type EventLoopOption func(*eventLoopConf)
+
+// 1.配置poller的个数, 默认是1
+func WithEventLoopPollers(n int) EventLoopOption {
+	return func(c *eventLoopConf) {
+		if n > 0 {
+			c.pollers = n
+		}
+	}
+}
+
+// 2.配置执行回调的go程个数, 默认是runtime.NumCPU()
+func WithEventLoopWorkers(n int) EventLoopOption {
+	return func(c *eventLoopConf) {
+		if n > 0 {
+			c.workers = n
+		}
+	}
+}
+
+// 3.配置待处理连接队列的大小, 队列满了poller会阻塞, 默认是1024
+func WithEventLoopQueueSize(n int) EventLoopOption {
+	return func(c *eventLoopConf) {
+		if n > 0 {
+			c.queueSize = n
+		}
+	}
+}
+
+// 4.使用边缘触发, 默认是水平触发
+func WithEventLoopEdgeTriggered() EventLoopOption {
+	return func(c *eventLoopConf) {
+		c.edgeTriggered = true
+	}
+}
+
+// 事件驱动的读模式, 连接不需要一个阻塞在ReadLoop里面的go程
+// poller读取网络数据, 解析frame和执行Callback交给有界的worker池
+// 同一个连接的数据同一时间只会在一个worker里面处理, 保证回调的顺序
+// 目前只支持linux(epoll), 其他平台和不支持的连接(比如tls)会退化成go程模式
+type EventLoop struct {
+	conf      eventLoopConf
+	tasks     chan *Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	pollers   []*poller
+}
+
+// 每个连接最多缓存多少还没有处理的数据, 超过之后暂停读取fd
+// 比这个大的frame, 每次恢复读取之后至少多读一次, 还是可以读完
+const maxEventConnBuffered = 256 * 1024
+
+// 每个连接在event loop里面的状态
+type eventConn struct {
+	mu         sync.Mutex
+	in         []byte // 读到但还没有处理的数据
+	scheduled  bool   // 是否已经交给worker
+	registered bool   // 是否还在poller里面
+	paused     bool   // 暂停读取fd, 限速或者缓存的数据太多的时候
+	err        error  // 读数据的错误, 处理完剩下的数据之后关闭连接
+	fd         int
+	p          *poller
+}
+
+func NewEventLoop(opts ...EventLoopOption) (*EventLoop, error) {
+	conf := eventLoopConf{pollers: 1, workers: runtime.NumCPU(), queueSize: 1024}
+	for _, o := range opts {
+		o(&conf)
+	}
+
+	el := &EventLoop{conf: conf, tasks: make(chan *Conn, conf.queueSize), done: make(chan struct{})}
+	if err := el.initPollers(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < conf.workers; i++ {
+		go el.worker()
+	}
+	return el, nil
+}
+
+// 停止event loop, 并且关闭所有注册的连接
+func (el *EventLoop) Close() error {
+	el.closeOnce.Do(func() {
+		close(el.done)
+		el.closePollers()
+	})
+	return nil
+}
+
+func (el *EventLoop) isClosed() bool {
+	select {
+	case <-el.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 把连接注册到event loop, 失败的时候调用者退化成go程模式
+func (el *EventLoop) add(c *Conn) error {
+	if el.isClosed() {
+		return ErrEventLoopClosed
+	}
+
+	// 先标记成已经调度, OnOpen之前不处理数据
+	e := &eventConn{scheduled: true}
+	// bufio模式下握手的时候可能已经缓存了数据
+	if c.br != nil && c.br.Buffered() > 0 {
+		buf, _ := c.br.Peek(c.br.Buffered())
+		e.in = append([]byte(nil), buf...)
+	}
+
+	c.elc = e
+	if err := el.register(c); err != nil {
+		c.elc = nil
+		return err
+	}
+
+	// 不再使用阻塞读的缓存
+	if c.fr.IsInit() {
+		_ = c.fr.Release()
+	}
+	c.br = nil
+
+	c.open()
+	el.dispatch(c)
+	return nil
+}
+
+func (el *EventLoop) dispatch(c *Conn) {
+	select {
+	case el.tasks <- c:
+	case <-el.done:
+	}
+}
+
+func (el *EventLoop) worker() {
+	payload := bytespool.GetBytes(1024 + enum.MaxFrameHeaderSize)
+	defer bytespool.PutBytes(payload)
+
+	for {
+		select {
+		case c := <-el.tasks:
+			el.process(c, payload)
+		case <-el.done:
+			return
+		}
+	}
+}
+
+// 处理连接上所有已经读到的数据, 不完整的frame留到下次
+func (el *EventLoop) process(c *Conn, payload *[]byte) {
+	e := c.elc
+	for {
+		e.mu.Lock()
+		buf := e.in
+		e.in = nil
+		if len(buf) == 0 {
+			e.scheduled = false
+			el.resumeRead(e)
+			readErr := e.err
+			e.mu.Unlock()
+			if readErr != nil {
+				el.closeConn(c, readErr)
+			}
+			return
+		}
+		e.mu.Unlock()
+
+		n, err := c.processEventData(buf, payload)
+		if err == errRateLimitWait {
+			el.delay(c, buf[n:], c.rl.wait)
+			return
+		}
+		if err != nil {
+			el.closeConn(c, err)
+			return
+		}
+
+		e.mu.Lock()
+		rest := buf[n:]
+		if len(e.in) == 0 {
+			// 没有新的数据, 剩下的是不完整的frame, 等poller读到更多数据再处理
+			if len(rest) > 0 {
+				e.in = append(buf[:0], rest...)
+			}
+			e.scheduled = false
+			el.resumeRead(e)
+			readErr := e.err
+			e.mu.Unlock()
+			if readErr != nil {
+				el.closeConn(c, readErr)
+			}
+			return
+		}
+		e.in = append(append(buf[:0], rest...), e.in...)
+		e.mu.Unlock()
+	}
+}
+
+// 限速(RateLimitDelay)的时候没有处理完的数据放回去, 定时器到了再重新调度
+// 等待期间不读fd, scheduled一直是true, 不会交给其他的worker
+func (el *EventLoop) delay(c *Conn, rest []byte, wait time.Duration) {
+	e := c.elc
+	e.mu.Lock()
+	el.pauseRead(e)
+	e.in = append(append([]byte(nil), rest...), e.in...)
+	e.mu.Unlock()
+
+	time.AfterFunc(wait, func() {
+		e.mu.Lock()
+		el.resumeRead(e)
+		e.mu.Unlock()
+		el.dispatch(c)
+	})
+}
+
+func (el *EventLoop) closeConn(c *Conn, err error) {
+	c.onCloseOnce.Do(&c.mu2, func() {
+		c.Callback.OnClose(c, err)
+	})
+	c.Close()
+}
+
+// 解析buf里面完整的frame, 返回处理了多少字节
+func (c *Conn) processEventData(buf []byte, payload *[]byte) (n int, err error) {
+	for n < len(buf) {
+		h, size, err := frame.ReadHeader(bytes.NewReader(buf[n:]), &c.readHeadArray)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return n, nil
+			}
+			return n, err
+		}
+
+		if h.PayloadLen < 0 || c.readMaxMessage > 0 && h.PayloadLen > c.readMaxMessage {
+			return n, c.writeErrAndOnClose(TooBigMessage, TooBigMessage)
+		}
+
+		total := size + int(h.PayloadLen)
+		if len(buf)-n < total {
+			return n, nil
+		}
+
+		f, err := frame.ReadFrameFromReaderV3(bytes.NewReader(buf[n:n+total]), nil, &c.readHeadArray, payload)
+		if err != nil {
+			return n, err
+		}
+		// 等令牌的frame第一次处理的时候已经统计过了
+		if c.rl == nil || !c.rl.waiting {
+			c.observeFrameRead(&f.FrameHeader)
+		}
+		if err = c.processFrame(f); err != nil {
+			if err == errRateLimitWait {
+				return n, err
+			}
+			return n + total, err
+		}
+		n += total
+	}
+	return n, nil
+}
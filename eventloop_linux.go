@@ -0,0 +1,282 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package quickws
+
+import (
+	"io"
+	"sync"
+	"syscall"
+)
+
+const (
+	pollerReadBufferSize = 64 * 1024
+	epollET              = 1 << 31 // syscall.EPOLLET是负数, 不能直接转成uint32
+)
+
+// 一个epoll实例
+type poller struct {
+	el    *EventLoop
+	epfd  int
+	wake  [2]int // 用于唤醒epoll_wait的pipe
+	mu    sync.Mutex
+	conns map[int]*Conn
+}
+
+func (el *EventLoop) initPollers() error {
+	for i := 0; i < el.conf.pollers; i++ {
+		p, err := newPoller(el)
+		if err != nil {
+			el.closePollers()
+			return err
+		}
+		el.pollers = append(el.pollers, p)
+	}
+
+	for _, p := range el.pollers {
+		go p.run()
+	}
+	return nil
+}
+
+func (el *EventLoop) closePollers() {
+	for _, p := range el.pollers {
+		p.close()
+	}
+}
+
+func newPoller(el *EventLoop) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{el: el, epfd: epfd, conns: make(map[int]*Conn)}
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(p.wake[0])
+		syscall.Close(p.wake[1])
+		return nil, err
+	}
+	return p, nil
+}
+
+// 关闭所有的连接, 唤醒run
+func (p *poller) close() {
+	p.mu.Lock()
+	conns := make([]*Conn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		p.el.closeConn(c, ErrEventLoopClosed)
+	}
+
+	// run退出的时候关闭epfd, 所以要在所有连接都从epoll删除之后再唤醒
+	_, _ = syscall.Write(p.wake[1], []byte{0})
+}
+
+func (el *EventLoop) register(c *Conn) error {
+	sc, ok := c.c.(syscall.Conn)
+	if !ok {
+		return ErrEventLoopNotSupported
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	fd := -1
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+
+	p := el.pollers[fd%len(el.pollers)]
+	e := c.elc
+	e.fd = fd
+	e.p = p
+	e.registered = true
+
+	p.mu.Lock()
+	p.conns[fd] = c
+	p.mu.Unlock()
+
+	ev := el.epollEvent(fd)
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		p.remove(fd, c)
+		return err
+	}
+	return nil
+}
+
+func (el *EventLoop) epollEvent(fd int) syscall.EpollEvent {
+	events := uint32(syscall.EPOLLIN | syscall.EPOLLRDHUP)
+	if el.conf.edgeTriggered {
+		events |= epollET
+	}
+	return syscall.EpollEvent{Events: events, Fd: int32(fd)}
+}
+
+// 暂停读取fd, 数据留在内核的缓冲区里面, 对端会因为tcp的窗口被限速
+// 只是从epoll里面删除, 连接还在poller里面, 关闭event loop的时候可以找到
+// 需要持有e.mu
+func (el *EventLoop) pauseRead(e *eventConn) {
+	if !e.registered || e.paused {
+		return
+	}
+	if err := syscall.EpollCtl(e.p.epfd, syscall.EPOLL_CTL_DEL, e.fd, nil); err == nil {
+		e.paused = true
+	}
+}
+
+// 恢复读取fd, 重新加到epoll的时候, 已经有数据的fd会马上通知
+// 需要持有e.mu
+func (el *EventLoop) resumeRead(e *eventConn) {
+	if !e.registered || !e.paused {
+		return
+	}
+	e.paused = false
+	ev := el.epollEvent(e.fd)
+	if err := syscall.EpollCtl(e.p.epfd, syscall.EPOLL_CTL_ADD, e.fd, &ev); err != nil {
+		e.err = err
+	}
+}
+
+// 关闭连接之前调用, 调用之后poller不会再读这个fd
+func (el *EventLoop) unregister(c *Conn) {
+	e := c.elc
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.p.deregister(e, c)
+}
+
+// 需要持有e.mu
+func (p *poller) deregister(e *eventConn, c *Conn) {
+	if !e.registered {
+		return
+	}
+	e.registered = false
+	if !e.paused {
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, e.fd, nil)
+	}
+	p.remove(e.fd, c)
+}
+
+func (p *poller) remove(fd int, c *Conn) {
+	p.mu.Lock()
+	if p.conns[fd] == c {
+		delete(p.conns, fd)
+	}
+	p.mu.Unlock()
+}
+
+func (p *poller) run() {
+	defer func() {
+		syscall.Close(p.epfd)
+		syscall.Close(p.wake[0])
+		syscall.Close(p.wake[1])
+	}()
+
+	events := make([]syscall.EpollEvent, 256)
+	buf := make([]byte, pollerReadBufferSize)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.wake[0] {
+				return
+			}
+
+			p.mu.Lock()
+			c := p.conns[fd]
+			p.mu.Unlock()
+			if c != nil {
+				p.read(c, buf)
+			}
+		}
+	}
+}
+
+// 读取fd上的数据, 交给worker处理
+func (p *poller) read(c *Conn, buf []byte) {
+	e := c.elc
+	e.mu.Lock()
+	// 暂停之前epoll_wait已经返回的事件
+	if !e.registered || e.paused {
+		e.mu.Unlock()
+		return
+	}
+
+	for {
+		n, err := syscall.Read(e.fd, buf)
+		if n > 0 {
+			e.in = append(e.in, buf[:n]...)
+		}
+
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if err != nil {
+			// 不再读这个fd, 处理完剩下的数据之后关闭连接
+			e.err = err
+			p.deregister(e, c)
+			break
+		}
+
+		// 缓存的数据太多, 等worker处理完再读
+		if len(e.in) >= maxEventConnBuffered {
+			p.el.pauseRead(e)
+			break
+		}
+
+		// 水平触发, 没读完的数据下次还会通知
+		if !p.el.conf.edgeTriggered {
+			break
+		}
+	}
+
+	dispatch := !e.scheduled && (len(e.in) > 0 || e.err != nil)
+	if dispatch {
+		e.scheduled = true
+	}
+	e.mu.Unlock()
+
+	if dispatch {
+		p.el.dispatch(c)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package quickws
+
+// 非linux平台没有实现, 注册的时候返回错误, 连接退化成go程模式
+type poller struct{}
+
+func (el *EventLoop) initPollers() error {
+	return nil
+}
+
+func (el *EventLoop) closePollers() {}
+
+func (el *EventLoop) register(c *Conn) error {
+	return ErrEventLoopNotSupported
+}
+
+func (el *EventLoop) unregister(c *Conn) {}
+
+func (el *EventLoop) pauseRead(e *eventConn) {}
+
+func (el *EventLoop) resumeRead(e *eventConn) {}
@@ -0,0 +1,175 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 注册到event loop之后直接返回, 不占用go程
+func newEventLoopServer(t *testing.T, el *EventLoop, closed chan error) *httptest.Server {
+	return newWSServer(t, (*Conn).StartReadLoop,
+		WithServerEventLoop(el),
+		WithServerDecompressAndCompress(),
+		WithServerCallbackFunc(nil, func(c *Conn, op Opcode, payload []byte) {
+			if err := c.WriteMessage(op, payload); err != nil {
+				t.Error(err)
+			}
+		}, func(c *Conn, err error) {
+			closed <- err
+		}))
+}
+
+func Test_EventLoop(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []EventLoopOption
+	}{
+		{name: "level triggered", opts: []EventLoopOption{WithEventLoopWorkers(2)}},
+		{name: "edge triggered", opts: []EventLoopOption{WithEventLoopWorkers(2), WithEventLoopPollers(2), WithEventLoopEdgeTriggered()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			el, err := NewEventLoop(tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer el.Close()
+
+			closed := make(chan error, 1)
+			ts := newEventLoopServer(t, el, closed)
+			defer ts.Close()
+
+			got := make(chan []byte, 16)
+			url := HTTPToWS(ts.URL)
+			c, err := Dial(url, WithClientDecompressAndCompress(), WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				got <- append([]byte(nil), payload...)
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.StartReadLoop()
+
+			// 大于poller读缓存的消息, 会分多次到达
+			large := make([]byte, 200*1024)
+			for i := range large {
+				large[i] = byte(i)
+			}
+			need := [][]byte{[]byte("hello"), large, bytes.Repeat([]byte("fragment"), 100)}
+			if err = c.WriteMessage(Text, need[0]); err != nil {
+				t.Fatal(err)
+			}
+			if err = c.WriteMessage(Binary, need[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err = c.writeFragment(Binary, need[2], 3); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, n := range need {
+				select {
+				case d := <-got:
+					if !bytes.Equal(d, n) {
+						t.Errorf("message %d: got %d bytes, need %d bytes", i, len(d), len(n))
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timeout %d", i)
+				}
+			}
+
+			c.WriteCloseTimeout(NormalClosure, time.Second)
+			select {
+			case <-closed:
+			case <-time.After(2 * time.Second):
+				t.Fatal("server OnClose timeout")
+			}
+		})
+	}
+
+	t.Run("close event loop", func(t *testing.T) {
+		el, err := NewEventLoop()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := make(chan error, 1)
+		ts := newEventLoopServer(t, el, closed)
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		c, err := Dial(url, WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		// 确认服务端已经注册
+		if err = c.WriteMessage(Text, []byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		el.Close()
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("server OnClose timeout")
+		}
+	})
+
+	t.Run("server close", func(t *testing.T) {
+		el, err := NewEventLoop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer el.Close()
+
+		closed := make(chan error, 2)
+		ts := newWSServer(t, (*Conn).StartReadLoop,
+			WithServerEventLoop(el),
+			WithServerCallbackFunc(nil, func(c *Conn, op Opcode, payload []byte) {
+				// 服务端自己关闭连接
+				c.Close()
+			}, func(c *Conn, err error) {
+				closed <- err
+			}))
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = c.WriteMessage(Text, []byte("close")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-closed:
+			if !errors.Is(err, ErrClosed) {
+				t.Fatalf("got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("server OnClose timeout")
+		}
+		select {
+		case err := <-closed:
+			t.Fatalf("OnClose called twice: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
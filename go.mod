@@ -7,4 +7,6 @@ require (
 	golang.org/x/net v0.23.0
 )
 
-require github.com/klauspost/compress v1.17.8 // indirect
+require github.com/klauspost/compress v1.17.8
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,162 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wheelTick  = 100 * time.Millisecond // 时间轮的精度
+	wheelSlots = 512                    // 时间轮的槽数, 转一圈是51.2s
+)
+
+// 所有连接共用一个时间轮, 海量连接的时候不需要每个连接一个timer
+var defaultTimingWheel = newTimingWheel(wheelTick, wheelSlots)
+
+// 简单的时间轮, 每个槽存放到期的心跳
+type timingWheel struct {
+	mu    sync.Mutex
+	tick  time.Duration
+	slots [][]*heartbeat
+	pos   int
+	once  sync.Once
+}
+
+func newTimingWheel(tick time.Duration, slots int) *timingWheel {
+	return &timingWheel{tick: tick, slots: make([][]*heartbeat, slots)}
+}
+
+// d时间之后触发h.fire
+func (w *timingWheel) add(h *heartbeat, d time.Duration) {
+	w.once.Do(func() {
+		go w.run()
+	})
+
+	ticks := int(d / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.mu.Lock()
+	h.rounds = (ticks - 1) / len(w.slots)
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], h)
+	w.mu.Unlock()
+}
+
+func (w *timingWheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	var fire []*heartbeat
+	for range ticker.C {
+		w.mu.Lock()
+		w.pos = (w.pos + 1) % len(w.slots)
+		bucket := w.slots[w.pos]
+		keep := bucket[:0]
+		for _, h := range bucket {
+			if h.isStopped() {
+				continue
+			}
+			if h.rounds > 0 {
+				h.rounds--
+				keep = append(keep, h)
+				continue
+			}
+			fire = append(fire, h)
+		}
+		// 清掉引用, 让关闭的连接可以被回收
+		for i := len(keep); i < len(bucket); i++ {
+			bucket[i] = nil
+		}
+		w.slots[w.pos] = keep
+		w.mu.Unlock()
+
+		for i, h := range fire {
+			// 写ping可能会阻塞, 不能卡住时间轮
+			go h.fire()
+			fire[i] = nil
+		}
+		fire = fire[:0]
+	}
+}
+
+// 每个连接的心跳状态
+// 发送ping之后等待pongTimeout, 期间没有收到pong就关闭连接
+type heartbeat struct {
+	c        *Conn
+	rounds   int   // 还需要转几圈, 由时间轮的锁保护
+	pingAt   int64 // 最近一次发送ping的时间, 只在fire里面访问
+	lastPong int64 // 最近一次收到pong的时间, 原子操作
+	waiting  bool  // 是否在等待pong
+	stopped  int32
+}
+
+// ReadLoop开始的时候再加到时间轮, 没有读取的时候收不到pong
+func (h *heartbeat) start() {
+	defaultTimingWheel.add(h, h.c.pingInterval)
+}
+
+// 收到pong的时候调用
+func (h *heartbeat) onPong() {
+	atomic.StoreInt64(&h.lastPong, time.Now().UnixNano())
+}
+
+func (h *heartbeat) stop() {
+	atomic.StoreInt32(&h.stopped, 1)
+}
+
+func (h *heartbeat) isStopped() bool {
+	return atomic.LoadInt32(&h.stopped) == 1
+}
+
+func (h *heartbeat) fire() {
+	c := h.c
+	if h.isStopped() || c.isClosed() {
+		return
+	}
+
+	now := time.Now()
+	if h.waiting {
+		// 检查pong
+		if atomic.LoadInt64(&h.lastPong) < h.pingAt {
+			h.stop()
+			c.writeErrAndOnClose(EndpointGoingAway, ErrPongTimeout)
+			c.Close()
+			return
+		}
+
+		h.waiting = false
+		next := time.Duration(h.pingAt+int64(c.pingInterval)) - time.Duration(now.UnixNano())
+		defaultTimingWheel.add(h, next)
+		return
+	}
+
+	h.pingAt = now.UnixNano()
+	h.waiting = true
+	// 先加到时间轮, 写ping阻塞的时候由下一次检查pong关闭连接
+	// 不修改写的deadline, 会影响用户并发的写
+	defaultTimingWheel.add(h, c.pongTimeout)
+	if err := c.WriteControl(Ping, nil); err != nil {
+		h.stop()
+		c.onCloseOnce.Do(&c.mu2, func() {
+			c.Callback.OnClose(c, err)
+		})
+		c.Close()
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Heartbeat(t *testing.T) {
+	newServer := func(t *testing.T, serverClose chan error, opts ...ServerOption) *httptest.Server {
+		return newWSServer(t, func(c *Conn) {
+			if c.Request().URL.Query().Get("delay") != "" {
+				time.Sleep(500 * time.Millisecond)
+			}
+			_ = c.ReadLoop()
+		}, append([]ServerOption{
+			WithServerPingInterval(200*time.Millisecond, 200*time.Millisecond),
+			WithServerOnCloseFunc(func(c *Conn, err error) {
+				serverClose <- err
+			})}, opts...)...)
+	}
+
+	noTimeout := func(t *testing.T, ts *httptest.Server, serverClose chan error, path string) {
+		url := HTTPToWS(ts.URL) + path
+		con, err := Dial(url, WithClientReplyPing())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+		con.StartReadLoop()
+
+		select {
+		case err := <-serverClose:
+			t.Fatalf("server closed: %v", err)
+		case <-time.After(time.Second):
+		}
+	}
+
+	// ReadLoop之前不发送ping, 收不到pong不会误判超时
+	t.Run("start after open", func(t *testing.T) {
+		serverClose := make(chan error, 1)
+		ts := newServer(t, serverClose)
+		defer ts.Close()
+		noTimeout(t, ts, serverClose, "/?delay=1")
+	})
+
+	// pong不受读限速的影响
+	t.Run("rate limited pong", func(t *testing.T) {
+		serverClose := make(chan error, 1)
+		ts := newServer(t, serverClose, WithServerRateLimit(RateLimit{ControlPerSec: 0.1, ControlBurst: 1, Action: RateLimitDrop}))
+		defer ts.Close()
+		noTimeout(t, ts, serverClose, "/")
+	})
+
+	t.Run("peer reply pong", func(t *testing.T) {
+		serverClose := make(chan error, 1)
+		ts := newServer(t, serverClose)
+		defer ts.Close()
+
+		var pings int32
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url, WithClientReplyPing(), WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+			if op == Ping {
+				atomic.AddInt32(&pings, 1)
+			}
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+		con.StartReadLoop()
+
+		select {
+		case err := <-serverClose:
+			t.Fatalf("server closed: %v", err)
+		case <-time.After(time.Second):
+		}
+
+		if atomic.LoadInt32(&pings) < 2 {
+			t.Errorf("got %d pings, need >= 2", atomic.LoadInt32(&pings))
+		}
+	})
+
+	t.Run("pong timeout", func(t *testing.T) {
+		serverClose := make(chan error, 1)
+		ts := newServer(t, serverClose)
+		defer ts.Close()
+
+		clientClose := make(chan error, 1)
+		url := HTTPToWS(ts.URL)
+		con, err := Dial(url, WithClientOnCloseFunc(func(c *Conn, err error) {
+			clientClose <- err
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+		con.StartReadLoop()
+
+		select {
+		case err := <-serverClose:
+			if !errors.Is(err, ErrPongTimeout) {
+				t.Errorf("got %v, need %v", err, ErrPongTimeout)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+
+		select {
+		case err := <-clientClose:
+			var ce *CloseErrMsg
+			if !errors.As(err, &ce) || ce.Code != EndpointGoingAway {
+				t.Errorf("got %v, need %v", err, EndpointGoingAway)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	})
+}
+
+func Test_TimingWheel(t *testing.T) {
+	w := newTimingWheel(10*time.Millisecond, 4)
+	var c Conn
+	h := &heartbeat{c: &c}
+	h.stop()
+	// 超过一圈的任务
+	w.add(h, 100*time.Millisecond)
+	w.mu.Lock()
+	rounds := h.rounds
+	w.mu.Unlock()
+	if rounds != 2 {
+		t.Errorf("got rounds %d, need 2", rounds)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, slot := range w.slots {
+		if len(slot) != 0 {
+			t.Errorf("slot %d: stopped heartbeat not removed", i)
+		}
+	}
+}
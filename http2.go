@@ -0,0 +1,179 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/deflate"
+	"github.com/antlabs/wsutil/fixedreader"
+)
+
+// RFC 8441, 基于HTTP/2 Extended CONNECT的websocket
+// 标准库的http2服务端需要设置环境变量GODEBUG=http2xconnect=1才会开启Extended CONNECT
+
+const strProtocolPseudoHeader = ":protocol"
+
+// 是否是HTTP/2的Extended CONNECT请求
+func isExtendedConnect(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8441#section-5
+// 没有Upgrade, Connection, Sec-WebSocket-Key这些字段
+func checkExtendedConnect(r *http.Request) (ecode int, err error) {
+	if !strings.EqualFold(r.Header.Get(strProtocolPseudoHeader), "websocket") {
+		return http.StatusBadRequest, ErrProtocolFieldValue
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return http.StatusUpgradeRequired, ErrSecWebSocketVersion
+	}
+	return 0, nil
+}
+
+// HTTP/2的升级, 请求的body和ResponseWriter组成双向的字节流
+// 一个stream的生命周期和handler绑定, handler返回之后stream就结束了, 所以handler里面要调用阻塞的ReadLoop
+func upgradeH2(w http.ResponseWriter, r *http.Request, conf *Config, cb Callback, responseHeader []http.Header) (wsCon *Conn, err error) {
+	if ecode, err := checkExtendedConnect(r); err != nil {
+		http.Error(w, err.Error(), ecode)
+		return nil, err
+	}
+
+	respHeader, err := admitHandshake(w, r, conf, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := checkSubprotocol(w, r, conf)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range respHeader {
+		w.Header()[k] = v
+	}
+
+	var pd deflate.PermessageDeflateConf
+	if conf.Decompression {
+		pd, err = deflate.GetConnPermessageDeflate(r.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resetPermessageDeflate(&pd, conf)
+	if pd.Decompression {
+		w.Header().Set("Sec-WebSocket-Extensions", deflate.GenSecWebSocketExtensions(pd))
+	}
+	if len(sub) > 0 {
+		w.Header().Set(strGetSecWebSocketProtocolKey, sub)
+	}
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err = rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	conn := newH2ServerConn(w, r, rc)
+	var fr fixedreader.FixedReader
+	if conf.parseMode == ParseModeWindows {
+		fr.Init(conn, bytespool.GetBytes(conf.initPayloadSize()))
+	}
+
+	if wsCon, err = newConn(conn, false, conf, fr, nil); err != nil {
+		return nil, err
+	}
+
+	wsCon.pd = pd
+	wsCon.subprotocol = sub
+	wsCon.request = r
+	if conf.sessionFunc != nil {
+		wsCon.SetSession(conf.sessionFunc(r))
+	}
+	wsCon.Callback = cb
+	if cb == nil {
+		wsCon.Callback = conf.cb
+	}
+	wsCon.ready()
+	return wsCon, nil
+}
+
+// 字符串形式的地址
+type strAddr string
+
+func (a strAddr) Network() string { return "tcp" }
+func (a strAddr) String() string  { return string(a) }
+
+// 服务端的HTTP/2 stream, 包装成net.Conn
+type h2ServerConn struct {
+	body   io.ReadCloser
+	w      io.Writer
+	rc     *http.ResponseController
+	wmu    sync.Mutex // ResponseWriter不能并发写
+	local  net.Addr
+	remote net.Addr
+	once   sync.Once
+}
+
+func newH2ServerConn(w http.ResponseWriter, r *http.Request, rc *http.ResponseController) *h2ServerConn {
+	c := &h2ServerConn{body: r.Body, w: w, rc: rc, remote: strAddr(r.RemoteAddr)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.local = addr
+	} else {
+		c.local = strAddr("")
+	}
+	return c
+}
+
+func (c *h2ServerConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *h2ServerConn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if n, err = c.w.Write(p); err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// 关闭请求的body, handler返回之后stream才会真正结束
+func (c *h2ServerConn) Close() (err error) {
+	c.once.Do(func() {
+		err = c.body.Close()
+	})
+	return err
+}
+
+func (c *h2ServerConn) LocalAddr() net.Addr  { return c.local }
+func (c *h2ServerConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2ServerConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *h2ServerConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *h2ServerConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
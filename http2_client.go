@@ -0,0 +1,375 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// RFC 8441 客户端
+// 每个websocket连接独占一个HTTP/2连接, 只使用stream 1
+// 标准库的http.Transport会拒绝:protocol这个header, 所以这里直接使用http2.Framer
+
+const (
+	http2NextProto            = "h2"
+	h2StreamID                = 1
+	h2SettingEnableConnect    = http2.SettingID(0x8) // SETTINGS_ENABLE_CONNECT_PROTOCOL
+	h2DefaultWindowSize       = 65535
+	h2DefaultMaxFrameSize     = 16384
+	h2ClientConnWindowIncr    = 1 << 24
+	h2ClientInitialWindowSize = 1 << 20
+)
+
+// hop-by-hop的header和websocket握手相关的header, 在HTTP/2里面不能发送
+var h2SkipHeaders = map[string]bool{
+	"connection":        true,
+	"upgrade":           true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"host":              true,
+	"sec-websocket-key": true,
+}
+
+// 客户端的HTTP/2 stream, 包装成net.Conn
+type h2ClientConn struct {
+	conn net.Conn
+	fr   *http2.Framer
+	wmu  sync.Mutex // Framer不能并发写
+
+	pr *io.PipeReader // 收到的DATA
+	pw *io.PipeWriter
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	connWindow   int64 // 连接级别的发送窗口
+	streamWindow int64 // stream级别的发送窗口
+	initWindow   int64 // 对端的SETTINGS_INITIAL_WINDOW_SIZE
+	maxFrameSize int
+	err          error // 读go程退出的原因
+
+	once sync.Once
+}
+
+func (c *h2ClientConn) writeFrame(fn func(fr *http2.Framer) error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return fn(c.fr)
+}
+
+// 握手: 发送连接前言和SETTINGS, 确认对端支持Extended CONNECT, 然后发送CONNECT请求
+func (d *DialOption) handshakeH2(ctx context.Context, conn net.Conn) (*h2ClientConn, *http.Response, error) {
+	stop := watchContext(ctx, conn)
+	c, rsp, err := d.handshakeH2Inner(conn)
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go c.readLoop()
+	return c, rsp, nil
+}
+
+func (d *DialOption) handshakeH2Inner(conn net.Conn) (*h2ClientConn, *http.Response, error) {
+	c := &h2ClientConn{
+		conn:         conn,
+		connWindow:   h2DefaultWindowSize,
+		streamWindow: h2DefaultWindowSize,
+		initWindow:   h2DefaultWindowSize,
+		maxFrameSize: h2DefaultMaxFrameSize,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.fr = http2.NewFramer(conn, conn)
+	c.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.pr, c.pw = io.Pipe()
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, nil, err
+	}
+	if err := c.fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2ClientInitialWindowSize}); err != nil {
+		return nil, nil, err
+	}
+	if err := c.fr.WriteWindowUpdate(0, h2ClientConnWindowIncr); err != nil {
+		return nil, nil, err
+	}
+
+	// 第一个frame必须是SETTINGS
+	f, err := c.fr.ReadFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok || sf.IsAck() {
+		return nil, nil, fmt.Errorf("%w: first frame is %s", ErrExtendedConnectNotSupported, f.Header().Type)
+	}
+	if v, ok := sf.Value(h2SettingEnableConnect); !ok || v != 1 {
+		return nil, nil, ErrExtendedConnectNotSupported
+	}
+	if err = c.applySettings(sf); err != nil {
+		return nil, nil, err
+	}
+	if err = c.fr.WriteSettingsAck(); err != nil {
+		return nil, nil, err
+	}
+
+	if err = c.fr.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamID,
+		BlockFragment: d.encodeH2Headers(),
+		EndHeaders:    true,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			if f.StreamID != h2StreamID {
+				continue
+			}
+			rsp, err := h2Response(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			if f.StreamEnded() {
+				return nil, nil, fmt.Errorf("%w %d", ErrWrongStatusCode, rsp.StatusCode)
+			}
+			return c, rsp, nil
+		case *http2.RSTStreamFrame:
+			return nil, nil, fmt.Errorf("%w: stream reset %s", ErrExtendedConnectNotSupported, f.ErrCode)
+		case *http2.GoAwayFrame:
+			return nil, nil, fmt.Errorf("%w: goaway %s", ErrExtendedConnectNotSupported, f.ErrCode)
+		default:
+			if err = c.handleFrame(f); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8441#section-4
+func (d *DialOption) encodeH2Headers() []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	write := func(name, value string) {
+		_ = enc.WriteField(hpack.HeaderField{Name: name, Value: value})
+	}
+
+	path := d.u.RequestURI()
+	write(":method", http.MethodConnect)
+	write(":protocol", "websocket")
+	write(":scheme", d.u.Scheme)
+	write(":path", path)
+	write(":authority", d.u.Host)
+	for k, vv := range d.Header {
+		lk := strings.ToLower(k)
+		if h2SkipHeaders[lk] {
+			continue
+		}
+		for _, v := range vv {
+			write(lk, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func h2Response(f *http2.MetaHeadersFrame) (*http.Response, error) {
+	status, err := strconv.Atoi(f.PseudoValue("status"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWrongStatusCode, f.PseudoValue("status"))
+	}
+
+	rsp := &http.Response{
+		StatusCode: status,
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}
+	for _, hf := range f.RegularFields() {
+		rsp.Header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	return rsp, nil
+}
+
+func (c *h2ClientConn) applySettings(sf *http2.SettingsFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return sf.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingInitialWindowSize:
+			c.streamWindow += int64(s.Val) - c.initWindow
+			c.initWindow = int64(s.Val)
+		case http2.SettingMaxFrameSize:
+			c.maxFrameSize = int(s.Val)
+		}
+		c.cond.Broadcast()
+		return nil
+	})
+}
+
+// 处理控制frame
+func (c *h2ClientConn) handleFrame(f http2.Frame) error {
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		if err := c.applySettings(f); err != nil {
+			return err
+		}
+		return c.writeFrame(func(fr *http2.Framer) error { return fr.WriteSettingsAck() })
+	case *http2.PingFrame:
+		if f.IsAck() {
+			return nil
+		}
+		return c.writeFrame(func(fr *http2.Framer) error { return fr.WritePing(true, f.Data) })
+	case *http2.WindowUpdateFrame:
+		c.mu.Lock()
+		if f.StreamID == 0 {
+			c.connWindow += int64(f.Increment)
+		} else if f.StreamID == h2StreamID {
+			c.streamWindow += int64(f.Increment)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// 读go程, DATA交给pipe, 读完之后再更新窗口
+func (c *h2ClientConn) readLoop() {
+	err := c.readLoopInner()
+	c.mu.Lock()
+	c.err = err
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.pw.CloseWithError(err)
+}
+
+func (c *h2ClientConn) readLoopInner() error {
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			return err
+		}
+
+		switch f := f.(type) {
+		case *http2.DataFrame:
+			if f.StreamID != h2StreamID {
+				continue
+			}
+			if data := f.Data(); len(data) > 0 {
+				if _, err = c.pw.Write(data); err != nil {
+					return err
+				}
+			}
+			// 包括padding, 都需要归还窗口
+			if n := f.Length; n > 0 {
+				if err = c.writeFrame(func(fr *http2.Framer) error {
+					if err := fr.WriteWindowUpdate(0, n); err != nil {
+						return err
+					}
+					return fr.WriteWindowUpdate(h2StreamID, n)
+				}); err != nil {
+					return err
+				}
+			}
+			if f.StreamEnded() {
+				return io.EOF
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == h2StreamID {
+				return http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode}
+			}
+		case *http2.GoAwayFrame:
+			return http2.GoAwayError{LastStreamID: f.LastStreamID, ErrCode: f.ErrCode}
+		default:
+			if err = c.handleFrame(f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *h2ClientConn) Read(p []byte) (int, error) {
+	return c.pr.Read(p)
+}
+
+// 按照发送窗口和最大frame大小拆成DATA frame
+func (c *h2ClientConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c.mu.Lock()
+		for c.err == nil && (c.connWindow <= 0 || c.streamWindow <= 0) {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			return n, err
+		}
+
+		size := int64(len(p))
+		for _, limit := range []int64{c.connWindow, c.streamWindow, int64(c.maxFrameSize)} {
+			if size > limit {
+				size = limit
+			}
+		}
+		c.connWindow -= size
+		c.streamWindow -= size
+		c.mu.Unlock()
+
+		chunk := p[:size]
+		if err = c.writeFrame(func(fr *http2.Framer) error { return fr.WriteData(h2StreamID, false, chunk) }); err != nil {
+			return n, err
+		}
+		n += int(size)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// 结束stream, 关闭底层连接
+func (c *h2ClientConn) Close() (err error) {
+	c.once.Do(func() {
+		_ = c.writeFrame(func(fr *http2.Framer) error { return fr.WriteRSTStream(h2StreamID, http2.ErrCodeCancel) })
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *h2ClientConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *h2ClientConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *h2ClientConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *h2ClientConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *h2ClientConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
@@ -0,0 +1,135 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+const http2xconnect = "http2xconnect=1"
+
+func newH2CServer(t *testing.T, opts ...ServerOption) *httptest.Server {
+	opts = append(opts, WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+		if err := c.WriteMessage(op, payload); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	// stream和handler的生命周期绑定, 这里必须阻塞在ReadLoop
+	ts := httptest.NewUnstartedServer(wsHandler(t, nil, opts...))
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	ts.Config.Protocols = &p
+	ts.Start()
+	return ts
+}
+
+// 标准库只在init的时候读取GODEBUG=http2xconnect, 没有设置的时候用子进程重新执行
+func runWithExtendedConnect(t *testing.T) bool {
+	if strings.Contains(os.Getenv("GODEBUG"), http2xconnect) {
+		return true
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GODEBUG="+http2xconnect)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	return false
+}
+
+func Test_HTTP2(t *testing.T) {
+	if !runWithExtendedConnect(t) {
+		return
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		ts := newH2CServer(t, WithServerDecompressAndCompress())
+		defer ts.Close()
+
+		got := make(chan []byte, 4)
+		var rspHeader http.Header
+		c, err := Dial(HTTPToWS(ts.URL),
+			WithClientHTTP2(),
+			WithClientDecompressAndCompress(),
+			WithClientBindHTTPHeader(&rspHeader),
+			WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				got <- append([]byte(nil), payload...)
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go c.ReadLoop()
+
+		if rspHeader.Get("Sec-WebSocket-Extensions") == "" {
+			t.Error("permessage-deflate not negotiated")
+		}
+
+		// 大于默认的发送窗口
+		need := [][]byte{[]byte("hello h2"), bytes.Repeat([]byte("0123456789"), 20*1024)}
+		for _, n := range need {
+			if err = c.WriteMessage(Binary, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, n := range need {
+			select {
+			case d := <-got:
+				if !bytes.Equal(d, n) {
+					t.Errorf("message %d: got %d bytes, need %d bytes", i, len(d), len(n))
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout %d", i)
+			}
+		}
+	})
+
+	t.Run("not support", func(t *testing.T) {
+		// 只支持HTTP/1.1的服务端, 不会回复HTTP/2的SETTINGS
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer ts.Close()
+
+		_, err := Dial(HTTPToWS(ts.URL), WithClientHTTP2(), WithClientDialTimeout(time.Second))
+		if err == nil {
+			t.Fatal("need error")
+		}
+	})
+
+	t.Run("wrong protocol", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodConnect, "/", nil)
+		r.ProtoMajor = 2
+		r.Header.Set(strProtocolPseudoHeader, "foo")
+		w := httptest.NewRecorder()
+		if _, err := Upgrade(w, r); !errors.Is(err, ErrProtocolFieldValue) {
+			t.Fatalf("got %v", err)
+		}
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d", w.Code)
+		}
+	})
+}
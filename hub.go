@@ -0,0 +1,195 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 慢消费者(发送队列满了)的处理策略
+type SlowConsumerPolicy int
+
+const (
+	// 丢弃这条消息
+	SlowConsumerDrop SlowConsumerPolicy = iota
+	// 使用TerminatingConnection关闭连接
+	SlowConsumerDisconnect
+)
+
+const defaultHubQueueSize = 256
+
+type HubOption func(*Hub)
+
+// 广播中心, 每个注册的连接有一个有界的发送队列和一个写go程
+// 同一个消息只编码一次(PreparedMessage), 然后写给所有的连接
+type Hub struct {
+	mu        sync.RWMutex
+	clients   map[*Conn]*hubClient
+	queueSize int
+	policy    SlowConsumerPolicy
+	dropped   uint64
+	closed    bool
+}
+
+type hubClient struct {
+	c     *Conn
+	queue chan *PreparedMessage
+	once  sync.Once
+	done  chan struct{}
+}
+
+// 1.配置每个连接发送队列的大小
+func WithHubQueueSize(size int) HubOption {
+	return func(h *Hub) {
+		if size > 0 {
+			h.queueSize = size
+		}
+	}
+}
+
+// 2.配置慢消费者的处理策略
+func WithHubSlowConsumerPolicy(policy SlowConsumerPolicy) HubOption {
+	return func(h *Hub) {
+		h.policy = policy
+	}
+}
+
+func NewHub(opts ...HubOption) *Hub {
+	h := &Hub{
+		clients:   make(map[*Conn]*hubClient),
+		queueSize: defaultHubQueueSize,
+	}
+	for _, o := range opts {
+		o(h)
+	}
+	return h
+}
+
+// 注册连接, 一般在OnOpen里面调用
+func (h *Hub) Register(c *Conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+
+	if _, ok := h.clients[c]; ok {
+		return nil
+	}
+
+	hc := &hubClient{c: c, queue: make(chan *PreparedMessage, h.queueSize), done: make(chan struct{})}
+	h.clients[c] = hc
+	go h.writeLoop(hc)
+	return nil
+}
+
+// 取消注册, 一般在OnClose里面调用. 写失败的连接会自动取消注册
+func (h *Hub) Unregister(c *Conn) {
+	h.mu.Lock()
+	hc, ok := h.clients[c]
+	delete(h.clients, c)
+	h.mu.Unlock()
+
+	if ok {
+		hc.stop()
+	}
+}
+
+func (hc *hubClient) stop() {
+	hc.once.Do(func() {
+		close(hc.done)
+	})
+}
+
+func (h *Hub) writeLoop(hc *hubClient) {
+	for {
+		select {
+		case pm := <-hc.queue:
+			if err := hc.c.WritePreparedMessage(pm); err != nil {
+				h.Unregister(hc.c)
+				return
+			}
+		case <-hc.done:
+			return
+		}
+	}
+}
+
+// 当前注册的连接数
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// 因为队列满了被丢弃的消息数
+func (h *Hub) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// 广播消息, 编码一次之后写给所有的连接
+func (h *Hub) Broadcast(op Opcode, data []byte) error {
+	pm, err := NewPreparedMessage(op, data)
+	if err != nil {
+		return err
+	}
+	return h.BroadcastPrepared(pm)
+}
+
+// 广播预先编码好的消息, 不会阻塞, 队列满了按SlowConsumerPolicy处理
+func (h *Hub) BroadcastPrepared(pm *PreparedMessage) error {
+	var slow []*Conn
+
+	h.mu.RLock()
+	if h.closed {
+		h.mu.RUnlock()
+		return ErrClosed
+	}
+
+	for c, hc := range h.clients {
+		select {
+		case hc.queue <- pm:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+			if h.policy == SlowConsumerDisconnect {
+				slow = append(slow, c)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		h.Unregister(c)
+		go func(c *Conn) {
+			c.writeErrAndOnClose(TerminatingConnection, ErrSlowConsumer)
+			c.Close()
+		}(c)
+	}
+	return nil
+}
+
+// 停止所有的写go程, 不会关闭连接
+func (h *Hub) Close() {
+	h.mu.Lock()
+	clients := h.clients
+	h.clients = make(map[*Conn]*hubClient)
+	h.closed = true
+	h.mu.Unlock()
+
+	for _, hc := range clients {
+		hc.stop()
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/antlabs/wsutil/fixedreader"
+)
+
+func Test_Hub(t *testing.T) {
+	t.Run("broadcast", func(t *testing.T) {
+		hub := NewHub()
+		defer hub.Close()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r, WithServerCallbackFunc(func(c *Conn) {
+				if err := hub.Register(c); err != nil {
+					t.Error(err)
+				}
+			}, nil, func(c *Conn, err error) {
+				hub.Unregister(c)
+			}))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_ = c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		const n = 3
+		data := make(chan string, n)
+		url := HTTPToWS(ts.URL)
+		for i := 0; i < n; i++ {
+			con, err := Dial(url, WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				data <- string(payload)
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer con.Close()
+			con.StartReadLoop()
+		}
+
+		for start := time.Now(); hub.Len() != n; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("got %d conns, need %d", hub.Len(), n)
+			}
+		}
+
+		if err := hub.Broadcast(Text, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			select {
+			case d := <-data:
+				if d != "hello" {
+					t.Errorf("got %s, need hello", d)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+		}
+	})
+
+	for name, policy := range map[string]SlowConsumerPolicy{"slow consumer drop": SlowConsumerDrop, "slow consumer disconnect": SlowConsumerDisconnect} {
+		policy := policy
+		t.Run(name, func(t *testing.T) {
+			hub := NewHub(WithHubQueueSize(1), WithHubSlowConsumerPolicy(policy))
+			defer hub.Close()
+
+			// 对端不读数据, 写会一直阻塞
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			var conf ConnOption
+			if err := conf.defaultSetting(); err != nil {
+				t.Fatal(err)
+			}
+			c, err := newConn(c1, false, &conf.Config, fixedreader.FixedReader{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Callback = conf.cb
+			defer c.Close()
+
+			if err = hub.Register(c); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 10; i++ {
+				if err = hub.Broadcast(Binary, []byte("hello")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if hub.Dropped() == 0 {
+				t.Error("need dropped messages")
+			}
+
+			need := 1
+			if policy == SlowConsumerDisconnect {
+				need = 0
+			}
+			if hub.Len() != need {
+				t.Errorf("got %d conns, need %d", hub.Len(), need)
+			}
+		})
+	}
+}
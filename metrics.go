@@ -0,0 +1,249 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 单个连接的统计数据
+type ConnStats struct {
+	BytesRead        uint64 // 读到的字节数, 包含帧头
+	BytesWritten     uint64 // 写出的字节数, 包含帧头
+	FramesRead       uint64
+	FramesWritten    uint64
+	FragmentsRead    uint64 // 属于分段消息的帧数
+	FragmentsWritten uint64
+	CompressIn       uint64 // 压缩前的字节数
+	CompressOut      uint64 // 压缩后的字节数
+	DecompressIn     uint64 // 解压前的字节数
+	DecompressOut    uint64 // 解压后的字节数
+}
+
+// 压缩率, 压缩后/压缩前, 没有压缩过返回0
+func (s ConnStats) CompressRatio() float64 {
+	if s.CompressIn == 0 {
+		return 0
+	}
+	return float64(s.CompressOut) / float64(s.CompressIn)
+}
+
+func (s *ConnStats) load() ConnStats {
+	return ConnStats{
+		BytesRead:        atomic.LoadUint64(&s.BytesRead),
+		BytesWritten:     atomic.LoadUint64(&s.BytesWritten),
+		FramesRead:       atomic.LoadUint64(&s.FramesRead),
+		FramesWritten:    atomic.LoadUint64(&s.FramesWritten),
+		FragmentsRead:    atomic.LoadUint64(&s.FragmentsRead),
+		FragmentsWritten: atomic.LoadUint64(&s.FragmentsWritten),
+		CompressIn:       atomic.LoadUint64(&s.CompressIn),
+		CompressOut:      atomic.LoadUint64(&s.CompressOut),
+		DecompressIn:     atomic.LoadUint64(&s.DecompressIn),
+		DecompressOut:    atomic.LoadUint64(&s.DecompressOut),
+	}
+}
+
+type closeCodeKey struct {
+	code   StatusCode
+	remote bool
+}
+
+// Observer的默认实现, 统计每个连接和所有连接的数据
+// 实现了http.Handler, 输出prometheus的文本格式, 不依赖prometheus的库
+type Metrics struct {
+	conns       sync.Map // *Conn -> *ConnStats
+	total       ConnStats
+	active      int64
+	opened      uint64
+	framesRead  [16]uint64 // 按opcode统计
+	framesWrite [16]uint64
+	mu          sync.Mutex
+	closeCodes  map[closeCodeKey]uint64
+}
+
+var _ Observer = (*Metrics)(nil)
+
+func NewMetrics() *Metrics {
+	return &Metrics{closeCodes: make(map[closeCodeKey]uint64)}
+}
+
+// 返回连接的统计数据, 连接已经关闭的时候返回一个临时的, 避免关闭之后的统计重新加到map里面
+func (m *Metrics) stats(c *Conn) *ConnStats {
+	if s, ok := m.conns.Load(c); ok {
+		return s.(*ConnStats)
+	}
+	return &ConnStats{}
+}
+
+func (m *Metrics) OnConnOpen(c *Conn) {
+	atomic.AddInt64(&m.active, 1)
+	atomic.AddUint64(&m.opened, 1)
+	m.conns.Store(c, &ConnStats{})
+}
+
+func (m *Metrics) OnConnClose(c *Conn) {
+	atomic.AddInt64(&m.active, -1)
+	m.conns.Delete(c)
+}
+
+func (m *Metrics) OnFrameRead(c *Conn, op Opcode, fin bool, n int) {
+	s := m.stats(c)
+	atomic.AddUint64(&s.BytesRead, uint64(n))
+	atomic.AddUint64(&s.FramesRead, 1)
+	atomic.AddUint64(&m.total.BytesRead, uint64(n))
+	atomic.AddUint64(&m.total.FramesRead, 1)
+	atomic.AddUint64(&m.framesRead[op&0xf], 1)
+	if !fin || op == Continuation {
+		atomic.AddUint64(&s.FragmentsRead, 1)
+		atomic.AddUint64(&m.total.FragmentsRead, 1)
+	}
+}
+
+func (m *Metrics) OnFrameWrite(c *Conn, op Opcode, fin bool, n int) {
+	s := m.stats(c)
+	atomic.AddUint64(&s.BytesWritten, uint64(n))
+	atomic.AddUint64(&s.FramesWritten, 1)
+	atomic.AddUint64(&m.total.BytesWritten, uint64(n))
+	atomic.AddUint64(&m.total.FramesWritten, 1)
+	atomic.AddUint64(&m.framesWrite[op&0xf], 1)
+	if !fin || op == Continuation {
+		atomic.AddUint64(&s.FragmentsWritten, 1)
+		atomic.AddUint64(&m.total.FragmentsWritten, 1)
+	}
+}
+
+func (m *Metrics) OnCompress(c *Conn, in, out int) {
+	s := m.stats(c)
+	atomic.AddUint64(&s.CompressIn, uint64(in))
+	atomic.AddUint64(&s.CompressOut, uint64(out))
+	atomic.AddUint64(&m.total.CompressIn, uint64(in))
+	atomic.AddUint64(&m.total.CompressOut, uint64(out))
+}
+
+func (m *Metrics) OnDecompress(c *Conn, in, out int) {
+	s := m.stats(c)
+	atomic.AddUint64(&s.DecompressIn, uint64(in))
+	atomic.AddUint64(&s.DecompressOut, uint64(out))
+	atomic.AddUint64(&m.total.DecompressIn, uint64(in))
+	atomic.AddUint64(&m.total.DecompressOut, uint64(out))
+}
+
+func (m *Metrics) OnCloseCode(c *Conn, code StatusCode, remote bool) {
+	m.mu.Lock()
+	m.closeCodes[closeCodeKey{code: code, remote: remote}]++
+	m.mu.Unlock()
+}
+
+// 单个连接的统计数据, 连接关闭之后返回false
+func (m *Metrics) ConnStats(c *Conn) (ConnStats, bool) {
+	s, ok := m.conns.Load(c)
+	if !ok {
+		return ConnStats{}, false
+	}
+	return s.(*ConnStats).load(), true
+}
+
+// 所有连接(包括已经关闭的)的统计数据
+func (m *Metrics) Total() ConnStats {
+	return m.total.load()
+}
+
+// 当前存活的连接数
+func (m *Metrics) ActiveConns() int64 {
+	return atomic.LoadInt64(&m.active)
+}
+
+// 某个关闭码出现的次数
+func (m *Metrics) CloseCodeCount(code StatusCode, remote bool) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closeCodes[closeCodeKey{code: code, remote: remote}]
+}
+
+var opcodeNames = [16]string{
+	Continuation: "continuation",
+	Text:         "text",
+	Binary:       "binary",
+	Close:        "close",
+	Ping:         "ping",
+	Pong:         "pong",
+}
+
+// 输出prometheus的文本格式
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	t := m.Total()
+
+	writeMetric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+
+	writeMetric("quickws_connections_active", "gauge", "Number of open websocket connections.", m.ActiveConns())
+	writeMetric("quickws_connections_total", "counter", "Number of websocket connections opened.", atomic.LoadUint64(&m.opened))
+	writeMetric("quickws_read_bytes_total", "counter", "Bytes read including frame headers.", t.BytesRead)
+	writeMetric("quickws_written_bytes_total", "counter", "Bytes written including frame headers.", t.BytesWritten)
+	writeMetric("quickws_read_fragments_total", "counter", "Frames read that belong to fragmented messages.", t.FragmentsRead)
+	writeMetric("quickws_written_fragments_total", "counter", "Frames written that belong to fragmented messages.", t.FragmentsWritten)
+	writeMetric("quickws_compress_in_bytes_total", "counter", "Bytes before permessage-deflate compression.", t.CompressIn)
+	writeMetric("quickws_compress_out_bytes_total", "counter", "Bytes after permessage-deflate compression.", t.CompressOut)
+	writeMetric("quickws_decompress_in_bytes_total", "counter", "Bytes before permessage-deflate decompression.", t.DecompressIn)
+	writeMetric("quickws_decompress_out_bytes_total", "counter", "Bytes after permessage-deflate decompression.", t.DecompressOut)
+
+	writeFrames := func(name, help string, frames *[16]uint64) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for op, name2 := range opcodeNames {
+			if name2 == "" {
+				continue
+			}
+			fmt.Fprintf(bw, "%s{opcode=%q} %d\n", name, name2, atomic.LoadUint64(&frames[op]))
+		}
+	}
+	writeFrames("quickws_read_frames_total", "Frames read by opcode.", &m.framesRead)
+	writeFrames("quickws_written_frames_total", "Frames written by opcode.", &m.framesWrite)
+
+	m.mu.Lock()
+	keys := make([]closeCodeKey, 0, len(m.closeCodes))
+	for k := range m.closeCodes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].code != keys[j].code {
+			return keys[i].code < keys[j].code
+		}
+		return !keys[i].remote && keys[j].remote
+	})
+	fmt.Fprintf(bw, "# HELP quickws_close_codes_total Close frames by status code and side.\n# TYPE quickws_close_codes_total counter\n")
+	for _, k := range keys {
+		side := "local"
+		if k.remote {
+			side = "remote"
+		}
+		fmt.Fprintf(bw, "quickws_close_codes_total{code=\"%d\",side=%q} %d\n", k.code, side, m.closeCodes[k])
+	}
+	m.mu.Unlock()
+
+	return bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
@@ -0,0 +1,123 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Metrics(t *testing.T) {
+	serverMetrics := NewMetrics()
+	clientMetrics := NewMetrics()
+
+	got := make(chan struct{}, 2)
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r,
+			WithServerObserver(serverMetrics),
+			WithServerDecompressAndCompress(),
+			WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				got <- struct{}{}
+			}))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = c.ReadLoop()
+		close(done)
+	}))
+	defer ts.Close()
+
+	url := HTTPToWS(ts.URL)
+	c, err := Dial(url, WithClientObserver(clientMetrics), WithClientDecompressAndCompress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if clientMetrics.ActiveConns() != 1 {
+		t.Errorf("got %d active conns, need 1", clientMetrics.ActiveConns())
+	}
+
+	data := bytes.Repeat([]byte("hello"), 200)
+	if err = c.WriteMessage(Text, data); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.writeFragment(Binary, data, 5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	stats, ok := clientMetrics.ConnStats(c)
+	if !ok {
+		t.Fatal("need conn stats")
+	}
+	if stats.FramesWritten < 3 || stats.FragmentsWritten < 2 {
+		t.Errorf("frames %d, fragments %d", stats.FramesWritten, stats.FragmentsWritten)
+	}
+	if stats.CompressIn != uint64(2*len(data)) || stats.CompressRatio() >= 1 {
+		t.Errorf("compress in %d, ratio %f", stats.CompressIn, stats.CompressRatio())
+	}
+
+	if err = c.WriteCloseTimeout(NormalClosure, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	st := serverMetrics.Total()
+	if st.BytesRead != clientMetrics.Total().BytesWritten {
+		t.Errorf("server read %d, client wrote %d", st.BytesRead, clientMetrics.Total().BytesWritten)
+	}
+	if st.DecompressOut != uint64(2*len(data)) {
+		t.Errorf("got %d decompressed bytes, need %d", st.DecompressOut, 2*len(data))
+	}
+	if serverMetrics.ActiveConns() != 0 {
+		t.Errorf("got %d active conns, need 0", serverMetrics.ActiveConns())
+	}
+	if n := serverMetrics.CloseCodeCount(NormalClosure, true); n != 1 {
+		t.Errorf("got %d remote close codes, need 1", n)
+	}
+	if n := clientMetrics.CloseCodeCount(NormalClosure, false); n != 1 {
+		t.Errorf("got %d local close codes, need 1", n)
+	}
+
+	w := httptest.NewRecorder()
+	serverMetrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, need := range []string{
+		"quickws_connections_total 1\n",
+		"quickws_connections_active 0\n",
+		`quickws_read_frames_total{opcode="text"} 1`,
+		`quickws_close_codes_total{code="1000",side="remote"} 1`,
+	} {
+		if !strings.Contains(body, need) {
+			t.Errorf("metrics output missing %q:\n%s", need, body)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// 多路复用使用的子协议, WithServerMux/WithClientMux会自动加到支持的子协议里面协商
+// 协商出这个子协议的时候, 连接上的binary消息交给多路复用层处理
+// 没有协商出来的时候和普通的连接一样, 不影响不支持多路复用的对端
+const MuxSubprotocol = "quickws.mux.v1"
+
+// 在子协议列表后面加上MuxSubprotocol, 复制一份, 不修改调用者的slice
+func appendMuxSubprotocol(subprotocols []string) []string {
+	for _, p := range subprotocols {
+		if p == MuxSubprotocol {
+			return subprotocols
+		}
+	}
+	return append(subprotocols[:len(subprotocols):len(subprotocols)], MuxSubprotocol)
+}
+
+// 每个binary消息的头部: 1字节的类型 + 4字节的channel id(大端)
+const muxHeaderSize = 5
+
+const (
+	muxFrameOpen   byte = iota + 1 // 打开channel, payload是channel的名字
+	muxFrameText                   // text消息
+	muxFrameBinary                 // binary消息
+	muxFrameWindow                 // 流控窗口更新, payload是4字节的增量
+	muxFrameClose                  // 关闭channel, payload是1字节的原因
+)
+
+const (
+	muxCloseNormal  byte = iota // 正常关闭
+	muxCloseRefused             // 对端拒绝打开
+)
+
+// 每个channel的发送窗口, 对端处理完一半之后更新窗口
+const muxWindowSize = 256 * 1024
+
+// channel id的上限, 用完之后从头分配没有使用的id
+var muxMaxID uint32 = math.MaxUint32
+
+// channel的回调, 和Callback一样, 只是参数是*Channel
+type ChannelCallback interface {
+	OnOpen(*Channel)
+	OnMessage(*Channel, Opcode, []byte)
+	OnClose(*Channel, error)
+}
+
+type funcToChannelCallback struct {
+	onOpen    func(*Channel)
+	onMessage func(*Channel, Opcode, []byte)
+	onClose   func(*Channel, error)
+}
+
+// 使用函数创建ChannelCallback, 不需要的回调可以传nil
+func ChannelCallbackFunc(onOpen func(*Channel), onMessage func(*Channel, Opcode, []byte), onClose func(*Channel, error)) ChannelCallback {
+	return &funcToChannelCallback{onOpen: onOpen, onMessage: onMessage, onClose: onClose}
+}
+
+func (f *funcToChannelCallback) OnOpen(ch *Channel) {
+	if f.onOpen != nil {
+		f.onOpen(ch)
+	}
+}
+
+func (f *funcToChannelCallback) OnMessage(ch *Channel, op Opcode, data []byte) {
+	if f.onMessage != nil {
+		f.onMessage(ch, op, data)
+	}
+}
+
+func (f *funcToChannelCallback) OnClose(ch *Channel, err error) {
+	if f.onClose != nil {
+		f.onClose(ch, err)
+	}
+}
+
+// 连接上的一个逻辑channel
+type Channel struct {
+	id   uint32
+	name string
+	m    *MuxConn
+	cb   ChannelCallback
+
+	mu        sync.Mutex
+	cond      sync.Cond
+	window    int64 // 发送窗口, 可以是负数
+	closed    bool
+	closeOnce sync.Once
+
+	consumed int // 已经处理, 还没有更新给对端的字节数, 只在读go程里面使用
+}
+
+// 一个连接上的多路复用层, 实现了Callback, 替换掉连接原来的回调
+// 客户端打开的channel id是奇数, 服务端打开的是偶数
+type MuxConn struct {
+	c      *Conn
+	cb     Callback // 连接原来的回调, 连接级别的事件和非binary消息交给它
+	accept func(*Channel) ChannelCallback
+
+	mu        sync.Mutex
+	channels  map[uint32]*Channel
+	nextID    uint32
+	closed    bool
+	closeHook func() // 连接关闭的时候调用, MuxPool用来删除连接
+}
+
+// 协商出了MuxSubprotocol并且开启了多路复用, 接管连接的回调
+func (c *Conn) initMux() {
+	if !c.mux || c.subprotocol != MuxSubprotocol {
+		return
+	}
+
+	m := &MuxConn{c: c, cb: c.Callback, accept: c.muxAccept, channels: make(map[uint32]*Channel), nextID: 2}
+	if c.client {
+		m.nextID = 1
+	}
+	c.muxConn = m
+	c.Callback = m
+}
+
+// 返回连接上的多路复用层, 没有协商出MuxSubprotocol的时候返回nil
+func (c *Conn) Mux() *MuxConn {
+	return c.muxConn
+}
+
+// 底层的连接
+func (m *MuxConn) Conn() *Conn {
+	return m.c
+}
+
+// 关闭底层的连接, 所有的channel都会收到OnClose
+func (m *MuxConn) Close() error {
+	return m.c.Close()
+}
+
+// 打开的channel个数
+func (m *MuxConn) NumChannels() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.channels)
+}
+
+func (m *MuxConn) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed || m.c.isClosed()
+}
+
+func (m *MuxConn) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := bytespool.GetBytes(muxHeaderSize + len(payload))
+	defer bytespool.PutBytes(buf)
+
+	b := (*buf)[:muxHeaderSize+len(payload)]
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	copy(b[muxHeaderSize:], payload)
+	return m.c.WriteMessage(opcode.Binary, b)
+}
+
+func (m *MuxConn) newChannel(id uint32, name string, cb ChannelCallback) *Channel {
+	ch := &Channel{id: id, name: name, m: m, cb: cb, window: muxWindowSize}
+	ch.cond.L = &ch.mu
+	return ch
+}
+
+// 打开一个channel, name会发给对端, 对端的accept可以根据name选择回调
+// 不等待对端确认, 返回之后就可以写数据, 对端拒绝的时候OnClose收到ErrChannelRefused
+func (m *MuxConn) Open(name string, cb ChannelCallback) (*Channel, error) {
+	if cb == nil {
+		cb = ChannelCallbackFunc(nil, nil, nil)
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id, err := m.allocID()
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	ch := m.newChannel(id, name, cb)
+	m.channels[id] = ch
+	m.mu.Unlock()
+
+	// 写完open才返回, 这个channel的数据都在open之后
+	if err := m.writeFrame(muxFrameOpen, id, []byte(name)); err != nil {
+		m.remove(id)
+		return nil, err
+	}
+	cb.OnOpen(ch)
+	return ch, nil
+}
+
+// 分配一个没有使用的id, 客户端是奇数, 服务端是偶数, 需要持有m.mu
+func (m *MuxConn) allocID() (uint32, error) {
+	first := uint32(2)
+	if m.c.client {
+		first = 1
+	}
+
+	for n := uint32(0); n <= muxMaxID/2; n++ {
+		id := m.nextID
+		// 超过上限或者uint32溢出, 从头开始
+		if id > muxMaxID || id < first {
+			id = first
+		}
+		m.nextID = id + 2
+		if _, ok := m.channels[id]; !ok {
+			return id, nil
+		}
+	}
+	return 0, ErrMuxIDExhausted
+}
+
+func (m *MuxConn) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.channels, id)
+	m.mu.Unlock()
+}
+
+func (m *MuxConn) channel(id uint32) *Channel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channels[id]
+}
+
+// 对端的帧格式不对, 使用ProtocolError关闭连接
+func (m *MuxConn) protocolError() {
+	_ = m.c.writeErrAndOnClose(ProtocolError, ErrMuxProtocol)
+	m.c.Close()
+}
+
+func (m *MuxConn) OnOpen(c *Conn) {
+	m.cb.OnOpen(c)
+}
+
+// binary消息按多路复用的格式解析, 其他的消息交给连接原来的回调
+func (m *MuxConn) OnMessage(c *Conn, op Opcode, payload []byte) {
+	if op != opcode.Binary {
+		m.cb.OnMessage(c, op, payload)
+		return
+	}
+
+	if len(payload) < muxHeaderSize {
+		m.protocolError()
+		return
+	}
+	typ, id, body := payload[0], binary.BigEndian.Uint32(payload[1:]), payload[muxHeaderSize:]
+
+	switch typ {
+	case muxFrameOpen:
+		m.onOpenFrame(id, string(body))
+	case muxFrameText, muxFrameBinary:
+		// 已经关闭的channel, 对端可能还没有收到close
+		if ch := m.channel(id); ch != nil {
+			dataOp := opcode.Binary
+			if typ == muxFrameText {
+				dataOp = opcode.Text
+			}
+			ch.cb.OnMessage(ch, dataOp, body)
+			ch.ack(len(body))
+		}
+	case muxFrameWindow:
+		if len(body) != 4 {
+			m.protocolError()
+			return
+		}
+		if ch := m.channel(id); ch != nil {
+			ch.mu.Lock()
+			ch.window += int64(binary.BigEndian.Uint32(body))
+			ch.cond.Broadcast()
+			ch.mu.Unlock()
+		}
+	case muxFrameClose:
+		if ch := m.channel(id); ch != nil {
+			m.remove(id)
+			var err error
+			if len(body) > 0 && body[0] == muxCloseRefused {
+				err = ErrChannelRefused
+			}
+			ch.onClose(err)
+		}
+	default:
+		m.protocolError()
+	}
+}
+
+// 对端打开channel, id必须是对端的奇偶性, 并且没有被使用
+func (m *MuxConn) onOpenFrame(id uint32, name string) {
+	m.mu.Lock()
+	if id%2 == m.nextID%2 || m.channels[id] != nil || m.closed {
+		closed := m.closed
+		m.mu.Unlock()
+		if !closed {
+			m.protocolError()
+		}
+		return
+	}
+	ch := m.newChannel(id, name, nil)
+	m.channels[id] = ch
+	m.mu.Unlock()
+
+	if m.accept != nil {
+		ch.cb = m.accept(ch)
+	}
+	if ch.cb == nil {
+		m.remove(id)
+		ch.markClosed()
+		_ = m.writeFrame(muxFrameClose, id, []byte{muxCloseRefused})
+		return
+	}
+	ch.cb.OnOpen(ch)
+}
+
+// 连接关闭, 先关闭所有的channel, 再调用连接原来的OnClose
+func (m *MuxConn) OnClose(c *Conn, err error) {
+	m.mu.Lock()
+	m.closed = true
+	channels := m.channels
+	m.channels = make(map[uint32]*Channel)
+	hook := m.closeHook
+	m.mu.Unlock()
+
+	chErr := err
+	if chErr == nil {
+		chErr = ErrClosed
+	}
+	for _, ch := range channels {
+		ch.onClose(chErr)
+	}
+	if hook != nil {
+		hook()
+	}
+	m.cb.OnClose(c, err)
+}
+
+// channel的id
+func (ch *Channel) ID() uint32 {
+	return ch.id
+}
+
+// 打开channel时候的名字
+func (ch *Channel) Name() string {
+	return ch.name
+}
+
+// channel所在的多路复用连接
+func (ch *Channel) Mux() *MuxConn {
+	return ch.m
+}
+
+// 发送消息, 只支持Text和Binary
+// 发送窗口不够的时候阻塞, 直到对端处理完之前的消息
+// 比窗口还大的消息, 窗口满了就可以发送
+// 不要在OnMessage里面给同一个连接上的channel发送大量数据, 读go程阻塞之后收不到窗口更新
+func (ch *Channel) WriteMessage(op Opcode, payload []byte) error {
+	typ := muxFrameBinary
+	switch op {
+	case opcode.Text:
+		typ = muxFrameText
+	case opcode.Binary:
+	default:
+		return ErrOpcode
+	}
+
+	need := int64(len(payload))
+	if need > muxWindowSize {
+		need = muxWindowSize
+	}
+
+	ch.mu.Lock()
+	for !ch.closed && ch.window < need {
+		ch.cond.Wait()
+	}
+	if ch.closed {
+		ch.mu.Unlock()
+		return ErrChannelClosed
+	}
+	ch.window -= int64(len(payload))
+	ch.mu.Unlock()
+
+	return ch.m.writeFrame(typ, ch.id, payload)
+}
+
+// 处理完n字节, 超过半个窗口的时候通知对端
+func (ch *Channel) ack(n int) {
+	ch.consumed += n
+	if ch.consumed < muxWindowSize/2 {
+		return
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(ch.consumed))
+	ch.consumed = 0
+	_ = ch.m.writeFrame(muxFrameWindow, ch.id, b[:])
+}
+
+// 关闭channel, 通知对端, 连接不会关闭
+func (ch *Channel) Close() error {
+	if !ch.markClosed() {
+		return nil
+	}
+
+	ch.m.remove(ch.id)
+	err := ch.m.writeFrame(muxFrameClose, ch.id, []byte{muxCloseNormal})
+	ch.closeOnce.Do(func() {
+		ch.cb.OnClose(ch, nil)
+	})
+	return err
+}
+
+// 标记关闭, 唤醒等待窗口的WriteMessage, 第一次关闭的时候返回true
+func (ch *Channel) markClosed() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return false
+	}
+	ch.closed = true
+	ch.cond.Broadcast()
+	return true
+}
+
+// 对端关闭或者连接关闭, 只调用一次OnClose
+func (ch *Channel) onClose(err error) {
+	ch.markClosed()
+	ch.closeOnce.Do(func() {
+		ch.cb.OnClose(ch, err)
+	})
+}
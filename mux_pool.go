@@ -0,0 +1,169 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// 连接服务端并且开启多路复用, 会覆盖WithClientSubprotocols, 只协商MuxSubprotocol
+// 服务端没有选择MuxSubprotocol的时候返回ErrMuxNotNegotiated
+// 返回之前已经在后台启动了ReadLoop
+func DialMux(rawURL string, opts ...ClientOption) (*MuxConn, error) {
+	return DialMuxContext(context.Background(), rawURL, opts...)
+}
+
+func DialMuxContext(ctx context.Context, rawURL string, opts ...ClientOption) (*MuxConn, error) {
+	opts = append(opts[:len(opts):len(opts)], WithClientSubprotocols([]string{MuxSubprotocol}), func(o *DialOption) {
+		o.mux = true
+	})
+
+	c, err := DialContext(ctx, rawURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := c.Mux()
+	if m == nil {
+		c.Close()
+		return nil, ErrMuxNotNegotiated
+	}
+	go func() { _ = c.ReadLoop() }()
+	return m, nil
+}
+
+type muxPoolEntry struct {
+	ready chan struct{} // 连接完成之后close
+	m     *MuxConn
+	err   error
+}
+
+// 客户端的连接池, 同一个url的channel复用一个连接
+// 连接关闭之后从池子里面删除, 下一次Open重新连接
+type MuxPool struct {
+	opts   []ClientOption
+	mu     sync.Mutex
+	conns  map[string]*muxPoolEntry
+	closed bool
+}
+
+// opts用于新建连接, 可以使用WithClientMux处理服务端打开的channel
+func NewMuxPool(opts ...ClientOption) *MuxPool {
+	return &MuxPool{opts: opts, conns: make(map[string]*muxPoolEntry)}
+}
+
+// 在rawURL对应的连接上打开一个channel, 没有可用的连接的时候新建一个
+// 同时打开同一个url的多个channel, 只会建立一个连接
+func (p *MuxPool) Open(ctx context.Context, rawURL string, name string, cb ChannelCallback) (*Channel, error) {
+	for retry := 0; ; retry++ {
+		m, err := p.get(ctx, rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		ch, err := m.Open(name, cb)
+		// 拿到连接之后连接刚好关闭了, 重新连接一次
+		if errors.Is(err, ErrClosed) && retry == 0 {
+			continue
+		}
+		return ch, err
+	}
+}
+
+func (p *MuxPool) get(ctx context.Context, rawURL string) (*MuxConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrMuxPoolClosed
+	}
+
+	if e := p.conns[rawURL]; e != nil {
+		p.mu.Unlock()
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if e.err != nil {
+			return nil, e.err
+		}
+		if !e.m.isClosed() {
+			return e.m, nil
+		}
+		p.remove(rawURL, e)
+		return p.get(ctx, rawURL)
+	}
+
+	e := &muxPoolEntry{ready: make(chan struct{})}
+	p.conns[rawURL] = e
+	p.mu.Unlock()
+
+	e.m, e.err = DialMuxContext(ctx, rawURL, p.opts...)
+	if e.err != nil {
+		p.remove(rawURL, e)
+		close(e.ready)
+		return nil, e.err
+	}
+
+	e.m.mu.Lock()
+	e.m.closeHook = func() { p.remove(rawURL, e) }
+	e.m.mu.Unlock()
+	close(e.ready)
+
+	// 连接的时候池子被关闭了
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		e.m.Close()
+		return nil, ErrMuxPoolClosed
+	}
+	return e.m, nil
+}
+
+// 删除rawURL对应的连接, e不为nil的时候只删除e
+func (p *MuxPool) remove(rawURL string, e *muxPoolEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur := p.conns[rawURL]; cur != nil && (e == nil || cur == e) {
+		delete(p.conns, rawURL)
+	}
+}
+
+// 池子里面的连接个数
+func (p *MuxPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// 关闭池子里面所有的连接, 之后的Open返回ErrMuxPoolClosed
+func (p *MuxPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[string]*muxPoolEntry)
+	p.mu.Unlock()
+
+	for _, e := range conns {
+		<-e.ready
+		if e.m != nil {
+			e.m.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 回显消息的channel
+func echoChannel(closed chan error) ChannelCallback {
+	return ChannelCallbackFunc(nil, func(ch *Channel, op Opcode, payload []byte) {
+		_ = ch.WriteMessage(op, append([]byte(ch.Name()+":"), payload...))
+	}, func(ch *Channel, err error) {
+		if closed != nil {
+			closed <- err
+		}
+	})
+}
+
+func recvString(t *testing.T, ch chan string) string {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return ""
+}
+
+func recvErr(t *testing.T, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func Test_Mux(t *testing.T) {
+	t.Run("channels", func(t *testing.T) {
+		serverClosed := make(chan error, 4)
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			return echoChannel(serverClosed)
+		}))
+
+		m, err := DialMux(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		if m.Conn().Subprotocol() != MuxSubprotocol {
+			t.Fatalf("got %s", m.Conn().Subprotocol())
+		}
+
+		got := make(chan string, 4)
+		cb := ChannelCallbackFunc(nil, func(ch *Channel, op Opcode, payload []byte) {
+			got <- string(payload)
+		}, nil)
+		a, err := m.Open("a", cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := m.Open("b", cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.ID()%2 != 1 || b.ID() != a.ID()+2 {
+			t.Fatalf("client ids %d %d", a.ID(), b.ID())
+		}
+
+		if err = a.WriteMessage(Text, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if v := recvString(t, got); v != "a:hello" {
+			t.Fatalf("got %s", v)
+		}
+
+		if err = a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err = recvErr(t, serverClosed); err != nil {
+			t.Fatalf("server OnClose got %v", err)
+		}
+		if err = a.WriteMessage(Text, []byte("x")); !errors.Is(err, ErrChannelClosed) {
+			t.Fatalf("got %v", err)
+		}
+
+		// 关闭a不影响b
+		if err = b.WriteMessage(Binary, []byte("world")); err != nil {
+			t.Fatal(err)
+		}
+		if v := recvString(t, got); v != "b:world" {
+			t.Fatalf("got %s", v)
+		}
+		if n := m.NumChannels(); n != 1 {
+			t.Fatalf("got %d channels", n)
+		}
+	})
+
+	t.Run("plain peer", func(t *testing.T) {
+		got := make(chan string, 1)
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			return echoChannel(nil)
+		}), WithServerCallbackFunc(func(c *Conn) {
+			if c.Mux() != nil {
+				t.Error("mux enabled for plain peer")
+			}
+		}, func(c *Conn, op Opcode, payload []byte) {
+			got <- string(payload)
+		}, nil))
+
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = c.WriteMessage(Binary, []byte("plain")); err != nil {
+			t.Fatal(err)
+		}
+		if v := recvString(t, got); v != "plain" {
+			t.Fatalf("got %s", v)
+		}
+
+		// 服务端没有配置MuxSubprotocol
+		plain := newWSServer(t, nil)
+		if _, err = DialMux(HTTPToWS(plain.URL)); !errors.Is(err, ErrMuxNotNegotiated) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			if ch.Name() == "deny" {
+				return nil
+			}
+			return echoChannel(nil)
+		}))
+
+		m, err := DialMux(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+
+		closed := make(chan error, 1)
+		ch, err := m.Open("deny", ChannelCallbackFunc(nil, nil, func(ch *Channel, err error) {
+			closed <- err
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = recvErr(t, closed); !errors.Is(err, ErrChannelRefused) {
+			t.Fatalf("got %v", err)
+		}
+		if err = ch.WriteMessage(Text, []byte("x")); !errors.Is(err, ErrChannelClosed) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("flow control", func(t *testing.T) {
+		gate := make(chan struct{})
+		var received int32
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			return ChannelCallbackFunc(nil, func(ch *Channel, op Opcode, payload []byte) {
+				<-gate
+				atomic.AddInt32(&received, 1)
+			}, nil)
+		}))
+
+		m, err := DialMux(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+
+		ch, err := m.Open("slow", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 一个窗口的数据不会阻塞
+		payload := bytes.Repeat([]byte{1}, muxWindowSize/4)
+		for i := 0; i < 4; i++ {
+			if err = ch.WriteMessage(Binary, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- ch.WriteMessage(Binary, payload) }()
+		select {
+		case err = <-done:
+			t.Fatalf("not blocked by window: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(gate)
+		if err = recvErr(t, done); err != nil {
+			t.Fatal(err)
+		}
+		for atomic.LoadInt32(&received) != 5 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("server open", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerMux(nil), WithServerCallbackFunc(func(c *Conn) {
+			ch, err := c.Mux().Open("push", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ch.ID()%2 != 0 {
+				t.Errorf("server id %d", ch.ID())
+			}
+			_ = ch.WriteMessage(Text, []byte("news"))
+		}, nil, nil))
+
+		got := make(chan string, 1)
+		m, err := DialMux(HTTPToWS(ts.URL), WithClientMux(func(ch *Channel) ChannelCallback {
+			return ChannelCallbackFunc(nil, func(ch *Channel, op Opcode, payload []byte) {
+				got <- ch.Name() + ":" + string(payload)
+			}, nil)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+
+		if v := recvString(t, got); v != "push:news" {
+			t.Fatalf("got %s", v)
+		}
+	})
+
+	t.Run("id exhausted", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			return echoChannel(nil)
+		}))
+
+		m, err := DialMux(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+
+		old := muxMaxID
+		muxMaxID = 5
+		defer func() { muxMaxID = old }()
+
+		var channels []*Channel
+		for i := 0; i < 3; i++ {
+			ch, err := m.Open("a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			channels = append(channels, ch)
+		}
+		if _, err = m.Open("a", nil); !errors.Is(err, ErrMuxIDExhausted) {
+			t.Fatalf("got %v", err)
+		}
+
+		// 关闭之后的id可以重新使用, 跳过还在使用的id
+		if err = channels[1].Close(); err != nil {
+			t.Fatal(err)
+		}
+		ch, err := m.Open("a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.ID() != channels[1].ID() {
+			t.Fatalf("got id %d, want %d", ch.ID(), channels[1].ID())
+		}
+	})
+
+	t.Run("conn close", func(t *testing.T) {
+		ts := newWSServer(t, nil, WithServerMux(func(ch *Channel) ChannelCallback {
+			return echoChannel(nil)
+		}))
+
+		m, err := DialMux(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		closed := make(chan error, 2)
+		for _, name := range []string{"a", "b"} {
+			if _, err = m.Open(name, ChannelCallbackFunc(nil, nil, func(ch *Channel, err error) {
+				closed <- err
+			})); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// 格式不对的消息, 服务端使用ProtocolError关闭连接
+		if err = m.Conn().WriteMessage(Binary, []byte{muxFrameText}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err = recvErr(t, closed); err == nil {
+				t.Fatal("channel closed without error")
+			}
+		}
+		if _, err = m.Open("c", nil); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v", err)
+		}
+	})
+}
+
+func Test_MuxPool(t *testing.T) {
+	var conns int32
+	ts := newWSServer(t, func(c *Conn) {
+		atomic.AddInt32(&conns, 1)
+		_ = c.ReadLoop()
+	}, WithServerMux(func(ch *Channel) ChannelCallback {
+		return echoChannel(nil)
+	}))
+
+	p := NewMuxPool()
+	defer p.Close()
+
+	got := make(chan string, 8)
+	cb := ChannelCallbackFunc(nil, func(ch *Channel, op Opcode, payload []byte) {
+		got <- string(payload)
+	}, nil)
+
+	// 并发打开, 只建立一个连接
+	var wg sync.WaitGroup
+	channels := make([]*Channel, 4)
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ch, err := p.Open(context.Background(), HTTPToWS(ts.URL), "c", cb)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			channels[i] = ch
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 || p.Len() != 1 {
+		t.Fatalf("got %d conns, pool len %d", n, p.Len())
+	}
+	m := channels[0].Mux()
+	for _, ch := range channels {
+		if ch.Mux() != m {
+			t.Fatal("channel not on the pooled conn")
+		}
+		if err := ch.WriteMessage(Text, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if v := recvString(t, got); v != "c:x" {
+			t.Fatalf("got %s", v)
+		}
+	}
+
+	// 连接关闭之后重新连接
+	m.Close()
+	for p.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ch, err := p.Open(context.Background(), HTTPToWS(ts.URL), "d", cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Mux() == m || atomic.LoadInt32(&conns) != 2 {
+		t.Fatal("pool did not redial")
+	}
+
+	p.Close()
+	if _, err = p.Open(context.Background(), HTTPToWS(ts.URL), "e", cb); !errors.Is(err, ErrMuxPoolClosed) {
+		t.Fatalf("got %v", err)
+	}
+}
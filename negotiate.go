@@ -0,0 +1,169 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	strSecWebSocketExtensions = "Sec-WebSocket-Extensions"
+	strPermessageDeflate      = "permessage-deflate"
+)
+
+// 握手协商出来的扩展, 比如permessage-deflate; client_no_context_takeover
+type Extension struct {
+	Name   string
+	Params map[string]string // 没有值的参数, value是空字符串
+}
+
+func (e Extension) String() string {
+	keys := make([]string, 0, len(e.Params))
+	for k := range e.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(e.Name)
+	for _, k := range keys {
+		sb.WriteString("; ")
+		sb.WriteString(k)
+		if v := e.Params[k]; v != "" {
+			sb.WriteString("=")
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
+// 协商出来的子协议, 没有协商的时候是空字符串
+// 客户端和服务端都可以使用
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// 服务端握手的请求, 可以在OnOpen里面读取header, url, 对端地址
+// 握手之后body已经不可用, 不要读取; 客户端返回nil
+func (c *Conn) Request() *http.Request {
+	return c.request
+}
+
+// 协商出来的扩展和参数
+func (c *Conn) Extensions() []Extension {
+	return c.extensions
+}
+
+// 不区分大小写的取值, WithClientHTTPHeader传入的header可能不是规范的key
+func headerValues(h http.Header, key string) (vals []string) {
+	for k, vv := range h {
+		if strings.EqualFold(k, key) {
+			vals = append(vals, vv...)
+		}
+	}
+	return vals
+}
+
+// 解析逗号分隔的token列表, 比如Sec-WebSocket-Protocol
+func parseTokenList(h http.Header, key string) (tokens []string) {
+	for _, v := range headerValues(h, key) {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6455#section-9.1
+func parseExtensions(h http.Header) (exts []Extension) {
+	for _, v := range headerValues(h, strSecWebSocketExtensions) {
+		for _, item := range strings.Split(v, ",") {
+			parts := strings.Split(item, ";")
+			name := strings.TrimSpace(parts[0])
+			if name == "" {
+				continue
+			}
+
+			ext := Extension{Name: name}
+			for _, p := range parts[1:] {
+				k, val, _ := strings.Cut(p, "=")
+				if k = strings.TrimSpace(k); k == "" {
+					continue
+				}
+				if ext.Params == nil {
+					ext.Params = make(map[string]string)
+				}
+				ext.Params[k] = strings.Trim(strings.TrimSpace(val), `"`)
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// 只保留permessage-deflate, 交给deflate包解析参数
+func permessageDeflateHeader(exts []Extension) http.Header {
+	h := make(http.Header)
+	for _, e := range exts {
+		if e.Name == strPermessageDeflate {
+			h.Add(strSecWebSocketExtensions, e.String())
+		}
+	}
+	return h
+}
+
+// https://datatracker.ietf.org/doc/html/rfc6455#section-4.2.2
+// 第5点, 服务端选择的子协议必须是客户端发送过的
+// 第6点, 服务端回复的扩展必须是客户端请求过的
+func (d *DialOption) validateNegotiation(rsp *http.Response) (subprotocol string, exts []Extension, err error) {
+	protocols := parseTokenList(rsp.Header, strGetSecWebSocketProtocolKey)
+	if len(protocols) > 1 {
+		return "", nil, fmt.Errorf("%w: %s", ErrSubprotocolNotOffered, strings.Join(protocols, ", "))
+	}
+
+	if len(protocols) == 1 {
+		subprotocol = protocols[0]
+		offered := false
+		for _, p := range parseTokenList(d.Header, strGetSecWebSocketProtocolKey) {
+			if p == subprotocol {
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			return "", nil, fmt.Errorf("%w: %s", ErrSubprotocolNotOffered, subprotocol)
+		}
+	}
+
+	requested := make(map[string]bool)
+	for _, e := range parseExtensions(d.Header) {
+		requested[e.Name] = true
+	}
+
+	exts = parseExtensions(rsp.Header)
+	seen := make(map[string]bool, len(exts))
+	for _, e := range exts {
+		if !requested[e.Name] || seen[e.Name] {
+			return "", nil, fmt.Errorf("%w: %s", ErrExtensionNotOffered, e.Name)
+		}
+		seen[e.Name] = true
+	}
+	return subprotocol, exts, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 手写101响应, 模拟不按规范协商的服务端
+func newRawUpgradeServer(t *testing.T, extra string) *httptest.Server {
+	return newHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n%s\r\n",
+			secWebSocketAcceptVal(r.Header.Get("Sec-WebSocket-Key")), extra)
+	}))
+}
+
+func Test_ValidateNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		extra string
+		opts  []ClientOption
+		need  error
+	}{
+		{
+			name:  "subprotocol not offered",
+			extra: "Sec-WebSocket-Protocol: chat\r\n",
+			need:  ErrSubprotocolNotOffered,
+		},
+		{
+			name:  "subprotocol not in list",
+			extra: "Sec-WebSocket-Protocol: chat\r\n",
+			opts:  []ClientOption{WithClientSubprotocols([]string{"json", "proto"})},
+			need:  ErrSubprotocolNotOffered,
+		},
+		{
+			name:  "more than one subprotocol",
+			extra: "Sec-WebSocket-Protocol: json, proto\r\n",
+			opts:  []ClientOption{WithClientSubprotocols([]string{"json", "proto"})},
+			need:  ErrSubprotocolNotOffered,
+		},
+		{
+			name:  "extension not requested",
+			extra: "Sec-WebSocket-Extensions: permessage-deflate\r\n",
+			need:  ErrExtensionNotOffered,
+		},
+		{
+			name:  "unknown extension",
+			extra: "Sec-WebSocket-Extensions: x-foo\r\n",
+			opts:  []ClientOption{WithClientDecompressAndCompress()},
+			need:  ErrExtensionNotOffered,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newRawUpgradeServer(t, tc.extra)
+			defer ts.Close()
+
+			_, err := Dial(HTTPToWS(ts.URL), tc.opts...)
+			if !errors.Is(err, tc.need) {
+				t.Fatalf("got %v, need %v", err, tc.need)
+			}
+		})
+	}
+
+	t.Run("custom extension", func(t *testing.T) {
+		ts := newRawUpgradeServer(t, "Sec-WebSocket-Extensions: x-foo; level=\"3\"\r\n")
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL), WithClientHTTPHeader(http.Header{
+			"Sec-WebSocket-Extensions": []string{"x-foo; level=3"},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		exts := c.Extensions()
+		if len(exts) != 1 || exts[0].Name != "x-foo" || exts[0].Params["level"] != "3" {
+			t.Fatalf("got %v", exts)
+		}
+	})
+
+	t.Run("negotiated", func(t *testing.T) {
+		serverSub := make(chan string, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r, WithServerSubprotocols([]string{"proto"}), WithServerDecompressAndCompress())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			serverSub <- r.Header.Get("Sec-WebSocket-Protocol")
+			c.Close()
+		}))
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL),
+			WithClientSubprotocols([]string{"json", "proto"}),
+			WithClientDecompressAndCompress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		<-serverSub
+
+		if c.Subprotocol() != "proto" {
+			t.Errorf("got subprotocol %q", c.Subprotocol())
+		}
+		exts := c.Extensions()
+		if len(exts) != 1 || exts[0].Name != strPermessageDeflate {
+			t.Errorf("got extensions %v", exts)
+		}
+	})
+}
@@ -0,0 +1,239 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 读go程每次从消息里面读取的最大字节数
+const netConnReadSize = 32 * 1024
+
+// 把websocket连接包装成net.Conn, 用于在websocket上面跑tcp协议(ssh, grpc等)
+type netConn struct {
+	c         *Conn
+	op        Opcode
+	rmu       sync.Mutex
+	startOnce sync.Once        // 第一次Read的时候启动读go程
+	data      chan netConnRead // 读go程读到的数据
+	buf       []byte           // 上一次Read没有拷贝完的数据
+	err       error            // 读go程的错误, 之后的Read都返回这个错误
+	rd        deadline         // Read的超时, 不设置到socket上, 超时之后连接还可以继续使用
+	done      chan struct{}    // Close的时候close, 通知读go程退出
+	closeOnce sync.Once
+}
+
+type netConnRead struct {
+	b   []byte
+	err error
+}
+
+var _ net.Conn = (*netConn)(nil)
+
+// 返回一个net.Conn, 每次Write发送一个op类型的消息, Read把收到的消息当成连续的字节流
+// 内部使用NextReader在单独的go程里面读取, 不能再调用ReadLoop
+// 对端发送close包之后, Read返回io.EOF
+// 收到和op类型不一样的消息时, 使用DataCannotAccept关闭连接, Read返回ErrOpcode
+// SetReadDeadline超时的时候Read返回os.ErrDeadlineExceeded(Timeout()为true), 重新设置之后可以继续读
+// 注意: WithServerReadTimeout/WithClientReadTimeout是socket上的超时, 超时之后连接会被关闭
+func NetConnAdapter(c *Conn, op Opcode) net.Conn {
+	return &netConn{c: c, op: op, data: make(chan netConnRead), rd: makeDeadline(), done: make(chan struct{})}
+}
+
+func (n *netConn) Read(p []byte) (int, error) {
+	n.rmu.Lock()
+	defer n.rmu.Unlock()
+
+	if len(n.buf) == 0 {
+		if n.err != nil {
+			return 0, n.err
+		}
+
+		n.startOnce.Do(func() { go n.readLoop() })
+		if isClosedChan(n.rd.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		select {
+		case r := <-n.data:
+			if r.err != nil {
+				n.err = r.err
+				return 0, r.err
+			}
+			n.buf = r.b
+		case <-n.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-n.done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	m := copy(p, n.buf)
+	n.buf = n.buf[m:]
+	return m, nil
+}
+
+// 读go程, 一个消息读完了继续读下一个消息, 空消息会跳过
+func (n *netConn) readLoop() {
+	scratch := make([]byte, netConnReadSize)
+	for {
+		op, r, err := n.c.NextReader()
+		if err == nil && op != n.op {
+			// 不同类型的消息不能拼到同一个字节流里面
+			n.c.writeErrAndOnClose(DataCannotAccept, ErrOpcode)
+			err = ErrOpcode
+		}
+		if err != nil {
+			n.send(netConnRead{err: closeToEOF(err)})
+			return
+		}
+
+		for {
+			rn, err := r.Read(scratch)
+			if rn > 0 && !n.send(netConnRead{b: append([]byte(nil), scratch[:rn]...)}) {
+				return
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				n.send(netConnRead{err: closeToEOF(err)})
+				return
+			}
+		}
+	}
+}
+
+// 等Read取走数据, 连接关闭的时候返回false
+func (n *netConn) send(r netConnRead) bool {
+	select {
+	case n.data <- r:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+// 对端发送的close包转成io.EOF
+func closeToEOF(err error) error {
+	var ce *CloseErrMsg
+	if errors.As(err, &ce) {
+		return io.EOF
+	}
+	return err
+}
+
+func (n *netConn) Write(p []byte) (int, error) {
+	if err := n.c.WriteMessage(n.op, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 发送close包之后关闭连接
+func (n *netConn) Close() error {
+	n.closeOnce.Do(func() { close(n.done) })
+	if n.c.isClosed() {
+		return ErrClosed
+	}
+	_ = n.c.WriteCloseTimeout(NormalClosure, 2*time.Second)
+	return n.c.Close()
+}
+
+func (n *netConn) LocalAddr() net.Addr {
+	return n.c.c.LocalAddr()
+}
+
+func (n *netConn) RemoteAddr() net.Addr {
+	return n.c.c.RemoteAddr()
+}
+
+func (n *netConn) SetDeadline(t time.Time) error {
+	n.rd.set(t)
+	return n.c.c.SetWriteDeadline(t)
+}
+
+func (n *netConn) SetReadDeadline(t time.Time) error {
+	n.rd.set(t)
+	return nil
+}
+
+func (n *netConn) SetWriteDeadline(t time.Time) error {
+	return n.c.c.SetWriteDeadline(t)
+}
+
+// 和net.Pipe一样的超时实现, 超时的时候close cancel
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// t为零值的时候取消超时
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 定时器已经触发, 等它close cancel
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
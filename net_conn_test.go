@@ -0,0 +1,191 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_NetConnAdapter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// 读到5个字节之后关闭, 5个字节跨了多个消息
+		nc := NetConnAdapter(c, Binary)
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(nc, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = nc.Write(buf); err != nil {
+			t.Error(err)
+			return
+		}
+		nc.Close()
+	}))
+	defer ts.Close()
+
+	url := HTTPToWS(ts.URL)
+	c, err := Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc := NetConnAdapter(c, Binary)
+	defer nc.Close()
+	for _, s := range []string{"he", "", "l", "lo"} {
+		if _, err = nc.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 一次只读一个字节, 测试部分读取
+	var got []byte
+	one := make([]byte, 1)
+	for {
+		n, err := nc.Read(one)
+		got = append(got, one[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if string(got) != "hello" {
+		t.Errorf("got %q, need hello", got)
+	}
+	if nc.RemoteAddr() == nil || nc.LocalAddr() == nil {
+		t.Error("need addr")
+	}
+}
+
+func Test_NetConnAdapter_ReadDeadline(t *testing.T) {
+	closed := make(chan error, 1)
+	result := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, WithServerOnCloseFunc(func(c *Conn, err error) { closed <- err }))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result <- func() error {
+			nc := NetConnAdapter(c, Binary)
+			buf := make([]byte, 5)
+			nc.SetReadDeadline(time.Now().Add(30 * time.Millisecond))
+			_, err := nc.Read(buf)
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				return fmt.Errorf("need timeout error, got %v", err)
+			}
+
+			// 超时之后重新设置, 还可以继续读
+			nc.SetReadDeadline(time.Time{})
+			if _, err = nc.Write([]byte("again")); err != nil {
+				return err
+			}
+			if _, err = io.ReadFull(nc, buf); err != nil {
+				return err
+			}
+			if string(buf) != "hello" {
+				return fmt.Errorf("got %q", buf)
+			}
+			return nil
+		}()
+	}))
+	defer ts.Close()
+
+	got := make(chan struct{})
+	c, err := Dial(HTTPToWS(ts.URL), WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+		close(got)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.StartReadLoop()
+
+	select {
+	case <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout")
+	}
+	if err = c.WriteMessage(Binary, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-result; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("OnClose called after read timeout: %v", err)
+	default:
+	}
+}
+
+func Test_NetConnAdapter_Opcode(t *testing.T) {
+	result := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = NetConnAdapter(c, Binary).Read(make([]byte, 5))
+		result <- err
+	}))
+	defer ts.Close()
+
+	code := make(chan StatusCode, 1)
+	c, err := Dial(HTTPToWS(ts.URL), WithClientOnCloseFunc(func(c *Conn, err error) {
+		var ce *CloseErrMsg
+		if errors.As(err, &ce) {
+			code <- ce.Code
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.StartReadLoop()
+
+	// text消息不能当成binary的字节流
+	if err = c.WriteMessage(Text, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-result; !errors.Is(err, ErrOpcode) {
+		t.Fatalf("got %v", err)
+	}
+	select {
+	case sc := <-code:
+		if sc != DataCannotAccept {
+			t.Fatalf("got close code %d", sc)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close timeout")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"encoding/binary"
+
+	"github.com/antlabs/wsutil/frame"
+)
+
+// 观察连接的运行数据, 用于统计流量, 帧数, 压缩率, 关闭码等
+// 这些函数在读写的路径上同步调用, 实现需要是并发安全并且足够快的
+type Observer interface {
+	// 连接建立
+	OnConnOpen(c *Conn)
+	// 连接关闭, 只会调用一次
+	OnConnClose(c *Conn)
+	// 读到一个帧, n是包含帧头的字节数
+	OnFrameRead(c *Conn, op Opcode, fin bool, n int)
+	// 写出一个帧, n是包含帧头的字节数
+	OnFrameWrite(c *Conn, op Opcode, fin bool, n int)
+	// 压缩, in是压缩前的大小, out是压缩后的大小
+	OnCompress(c *Conn, in, out int)
+	// 解压缩, in是解压前的大小, out是解压后的大小
+	OnDecompress(c *Conn, in, out int)
+	// 收到或者发送close包, remote为true表示是对端发过来的
+	OnCloseCode(c *Conn, code StatusCode, remote bool)
+}
+
+// 空实现, 可以内嵌到自己的结构体里面, 只实现关心的函数
+type NopObserver struct{}
+
+func (NopObserver) OnConnOpen(c *Conn)                                {}
+func (NopObserver) OnConnClose(c *Conn)                               {}
+func (NopObserver) OnFrameRead(c *Conn, op Opcode, fin bool, n int)   {}
+func (NopObserver) OnFrameWrite(c *Conn, op Opcode, fin bool, n int)  {}
+func (NopObserver) OnCompress(c *Conn, in, out int)                   {}
+func (NopObserver) OnDecompress(c *Conn, in, out int)                 {}
+func (NopObserver) OnCloseCode(c *Conn, code StatusCode, remote bool) {}
+
+// 帧头的大小
+func frameHeaderSize(payloadLen int, mask bool) int {
+	n := 2
+	switch {
+	case payloadLen > 65535:
+		n += 8
+	case payloadLen > 125:
+		n += 2
+	}
+	if mask {
+		n += 4
+	}
+	return n
+}
+
+func (c *Conn) observeFrameRead(f *frame.FrameHeader) {
+	if c.observer == nil {
+		return
+	}
+	c.observer.OnFrameRead(c, f.Opcode, f.GetFin(), frameHeaderSize(int(f.PayloadLen), f.Mask)+int(f.PayloadLen))
+}
+
+func (c *Conn) observeFrameWrite(op Opcode, fin bool, payloadLen int) {
+	if c.observer == nil {
+		return
+	}
+	c.observer.OnFrameWrite(c, op, fin, frameHeaderSize(payloadLen, c.client)+payloadLen)
+}
+
+// close包的payload前两个字节是关闭码
+func (c *Conn) observeCloseCode(payload []byte, remote bool) {
+	if c.observer == nil || len(payload) < 2 {
+		return
+	}
+	c.observer.OnCloseCode(c, StatusCode(binary.BigEndian.Uint16(payload)), remote)
+}
@@ -55,15 +55,18 @@ decode:
 	defer c.wmu.Unlock()
 	// 处理上下文接管和非上下文接管两种情况
 	// bit 为啥放在参数里面传递, 因为非上下文接管的时候，也需要正确处理bit
-	return c.enCtx.Compress(payload, bit)
+	encodePayload, err = c.enCtx.Compress(payload, bit)
+	if err == nil && c.observer != nil {
+		c.observer.OnCompress(c, len(*payload), len(*encodePayload))
+	}
+	return encodePayload, err
 }
 
 // 解压缩入口函数
 // 解压目前只在一个go程里面按序列处理，所以不需要加锁
 func (c *Conn) decode(payload *[]byte) (decodePayload *[]byte, err error) {
-	ct := (c.pd.ClientContextTakeover && c.client || !c.client && c.pd.ServerContextTakeover) && c.pd.Decompression
 	// 上下文接管
-	if ct {
+	if c.decompressTakeover() {
 		if c.deCtx == nil {
 
 			bit := uint8(0)
@@ -84,5 +87,14 @@ func (c *Conn) decode(payload *[]byte) (decodePayload *[]byte, err error) {
 	// 上下文接管, deCtx是nil
 	// 非上下文接管, deCtx是非nil
 
-	return c.deCtx.Decompress(payload, c.readMaxMessage)
+	decodePayload, err = c.deCtx.Decompress(payload, c.readMaxMessage)
+	if err == nil && c.observer != nil {
+		c.observer.OnDecompress(c, len(*payload), len(*decodePayload))
+	}
+	return decodePayload, err
+}
+
+// 解压缩是否使用上下文接管
+func (c *Conn) decompressTakeover() bool {
+	return (c.pd.ClientContextTakeover && c.client || !c.client && c.pd.ServerContextTakeover) && c.pd.Decompression
 }
@@ -0,0 +1,170 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/deflate"
+	"github.com/antlabs/wsutil/frame"
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// 预先编码好的消息, 用于广播
+// 同一个消息发给多个连接时, frame header的编码和压缩只需要做一次
+// 按(是否压缩, 压缩的window bits)缓存编码结果, 缓存的帧都没有mask
+// 客户端连接每次写的时候复制一份payload, 使用新的mask
+type PreparedMessage struct {
+	op     Opcode
+	data   []byte
+	mu     sync.Mutex
+	frames [2][maxWindowBits + 1]preparedFrame // [compress][bits]
+}
+
+// window bits的最大值, rfc7692规定是8到15, 0表示没有协商
+const maxWindowBits = 15
+
+// 编码好的服务端帧, payload是frame的后半部分
+type preparedFrame struct {
+	frame   []byte
+	payload []byte
+}
+
+// data会被拷贝一份, 调用之后可以修改data
+func NewPreparedMessage(op Opcode, data []byte) (*PreparedMessage, error) {
+	if op.IsControl() && len(data) > maxControlFrameSize {
+		return nil, ErrMaxControlFrameSize
+	}
+
+	return &PreparedMessage{op: op, data: append([]byte(nil), data...)}, nil
+}
+
+func boolToIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 返回编码好的帧, 第一次使用的时候编码
+// bits是连接协商出来的max_window_bits, 不压缩的时候忽略
+func (pm *PreparedMessage) frame(compress bool, bits uint8) (*preparedFrame, error) {
+	if !compress || bits > maxWindowBits {
+		bits = 0
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	f := &pm.frames[boolToIndex(compress)][bits]
+	if f.frame != nil {
+		return f, nil
+	}
+
+	payload := pm.data
+	if compress {
+		// 非上下文接管, 压缩结果只和window bits有关
+		encodePayload, err := (*deflate.CompressContextTakeover)(nil).Compress(&payload, bits)
+		if err != nil {
+			return nil, err
+		}
+		payload = append([]byte(nil), *encodePayload...)
+		bytespool.PutBytes(encodePayload)
+	}
+
+	var buf bytes.Buffer
+	if err := frame.WriteFrameToBytes(&buf, payload, true, compress, false, pm.op, 0); err != nil {
+		return nil, err
+	}
+	f.frame = buf.Bytes()
+	f.payload = f.frame[len(f.frame)-len(payload):]
+	return f, nil
+}
+
+// 是否开启了上下文接管的压缩, 这时候每个连接的压缩结果都不一样
+func (c *Conn) compressContextTakeover() bool {
+	return (c.pd.ClientContextTakeover && c.client || !c.client && c.pd.ServerContextTakeover) && c.pd.Compression
+}
+
+// 压缩使用的window bits, 和encoode保持一致
+func (c *Conn) compressWindowBits() uint8 {
+	if c.client {
+		return c.pd.ClientMaxWindowBits
+	}
+	return c.pd.ServerMaxWindowBits
+}
+
+// 写入预先编码好的消息
+// 连接开启了上下文接管的压缩时, 退化成WriteMessage
+// 配置了WithServerWriteQueue的时候, 和WriteMessage一样按顺序放到发送队列
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) (err error) {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	if pm.op == opcode.Text {
+		if !c.utf8Check(pm.data) {
+			return ErrTextNotUTF8
+		}
+	}
+
+	compress := c.pd.Compression && (pm.op == opcode.Text || pm.op == opcode.Binary)
+	if compress && c.compressContextTakeover() {
+		return c.WriteMessage(pm.op, pm.data)
+	}
+
+	if c.wq != nil && (pm.op == opcode.Text || pm.op == opcode.Binary) {
+		return c.enqueuePreparedMessage(pm)
+	}
+	return c.writePreparedMessage(pm)
+}
+
+func (c *Conn) writePreparedMessage(pm *PreparedMessage) (err error) {
+	if c.isClosed() {
+		return ErrClosed
+	}
+
+	compress := c.pd.Compression && (pm.op == opcode.Text || pm.op == opcode.Binary)
+	f, err := pm.frame(compress, c.compressWindowBits())
+	if err != nil {
+		return err
+	}
+	if compress && c.observer != nil {
+		c.observer.OnCompress(c, len(pm.data), len(f.payload))
+	}
+
+	// 先把延迟写缓冲区里面的数据写出去, 保证消息的顺序
+	c.wmu.Lock()
+	if err = c.delayWriteErr(); err == nil {
+		err = c.flushDelayBuf()
+	}
+	if err == nil {
+		if c.client {
+			// 客户端每个帧都需要新的mask, 缓存的payload不能修改
+			err = c.writeFrame(pm.op, f.payload, compress, false)
+		} else {
+			_, err = c.c.Write(f.frame)
+		}
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.observeFrameWrite(pm.op, true, len(f.payload))
+	return nil
+}
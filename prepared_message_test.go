@@ -0,0 +1,188 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antlabs/wsutil/fixedreader"
+	"github.com/antlabs/wsutil/mask"
+)
+
+func Test_PreparedMessage(t *testing.T) {
+	pm, err := NewPreparedMessage(Text, testTextMessage64kb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		server []ServerOption
+		client []ClientOption
+	}{
+		{name: "no-compression"},
+		{
+			name:   "compression",
+			server: []ServerOption{WithServerDecompressAndCompress()},
+			client: []ClientOption{WithClientDecompressAndCompress()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]ServerOption{WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				// 服务端收到客户端的PreparedMessage之后, 再用PreparedMessage回过去
+				if !bytes.Equal(payload, testTextMessage64kb) {
+					t.Errorf("server got %d bytes", len(payload))
+				}
+				if err := c.WritePreparedMessage(pm); err != nil {
+					t.Error(err)
+				}
+			})}, tc.server...)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Upgrade(w, r, opts...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = c.ReadLoop()
+			}))
+			defer ts.Close()
+
+			data := make(chan []byte, 1)
+			url := HTTPToWS(ts.URL)
+			con, err := Dial(url, append([]ClientOption{WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				data <- append([]byte(nil), payload...)
+			})}, tc.client...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer con.Close()
+			con.StartReadLoop()
+
+			if err = con.WritePreparedMessage(pm); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case d := <-data:
+				if !bytes.Equal(d, testTextMessage64kb) {
+					t.Errorf("client got %d bytes", len(d))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+		})
+	}
+
+	t.Run("cache", func(t *testing.T) {
+		f1, err := pm.frame(true, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, _ := pm.frame(true, 0)
+		if &f1.frame[0] != &f2.frame[0] {
+			t.Error("frame not cached")
+		}
+
+		// 不同的window bits分开缓存
+		f3, err := pm.frame(true, 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if &f1.frame[0] == &f3.frame[0] {
+			t.Error("window bits ignored")
+		}
+	})
+
+	t.Run("client mask", func(t *testing.T) {
+		var conf ConnOption
+		if err := conf.defaultSetting(); err != nil {
+			t.Fatal(err)
+		}
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c, err := newConn(g, true, &conf.Config, fixedreader.FixedReader{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		small, _ := NewPreparedMessage(Binary, []byte("hello"))
+		masks := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			g.buf = g.buf[:0]
+			if err = c.WritePreparedMessage(small); err != nil {
+				t.Fatal(err)
+			}
+			// 2字节的header, 4字节的mask
+			key := g.buf[2:6]
+			payload := append([]byte(nil), g.buf[6:]...)
+			mask.Mask(payload, binary.LittleEndian.Uint32(key))
+			if string(payload) != "hello" {
+				t.Fatalf("got %q", payload)
+			}
+			masks[string(key)] = true
+		}
+		if len(masks) == 1 {
+			t.Error("mask key reused")
+		}
+	})
+
+	t.Run("write queue order", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 4, WriteQueueBlock, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2")
+
+		m3, _ := NewPreparedMessage(Text, []byte("m3"))
+		if err := c.WritePreparedMessage(m3); err != nil {
+			t.Fatal(err)
+		}
+		close(g.gate)
+		if err := c.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2,m3" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("delay write order", func(t *testing.T) {
+		g := &gateConn{gate: make(chan struct{})}
+		close(g.gate)
+		c := newDelayWriteConn(t, g, make(chan error, 1),
+			WithServerMaxDelayWriteNum(100),
+			WithServerMaxDelayWriteDuration(time.Hour))
+
+		if err := c.WriteMessageDelay(Text, []byte("m1")); err != nil {
+			t.Fatal(err)
+		}
+		m2, _ := NewPreparedMessage(Text, []byte("m2"))
+		if err := c.WritePreparedMessage(m2); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("control too large", func(t *testing.T) {
+		if _, err := NewPreparedMessage(Ping, make([]byte, 126)); err != ErrMaxControlFrameSize {
+			t.Errorf("got %v, need %v", err, ErrMaxControlFrameSize)
+		}
+	})
+}
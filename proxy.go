@@ -16,73 +16,364 @@ package quickws
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
-	"github.com/antlabs/wsutil/hostname"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
 )
 
 type (
-	dialFunc  func(network, addr string, timeout time.Duration) (c net.Conn, err error)
-	httpProxy struct {
+	dialContextFunc func(ctx context.Context, network, addr string) (c net.Conn, err error)
+	httpProxy       struct {
 		proxyAddr   *url.URL
-		dialTimeout func(network, addr string, timeout time.Duration) (c net.Conn, err error)
-		timeout     time.Duration
+		dialContext dialContextFunc
+		tlsConfig   *tls.Config   // 不为nil时, 和proxy之间使用tls(https://)
+		header      http.Header   // CONNECT请求额外的header
+		auth        ProxyAuthFunc // 代理返回407的时候调用
 	}
+
+	// 代理相关的配置
+	proxyOption struct {
+		tlsConfig *tls.Config
+		header    http.Header
+		auth      ProxyAuthFunc
+	}
+
+	socks5Proxy struct {
+		proxyAddr   *url.URL
+		dialContext dialContextFunc
+	}
+)
+
+const (
+	maxProxyErrorBody  = 4 * 1024 // ProxyError里面最多保存的body大小
+	maxProxyAuthRounds = 8        // 最多认证的次数, 防止和代理无限循环
 )
 
-var _ DialerTimeout = (*httpProxy)(nil)
+// 代理返回407的时候调用, challenge在resp.Header的Proxy-Authenticate里面
+// 返回的header会加到下一次的CONNECT请求里面(比如Proxy-Authorization), 返回空的header表示放弃认证
+// NTLM/Negotiate这种多轮的认证, 每一轮都会调用一次
+type ProxyAuthFunc func(proxyURL *url.URL, resp *http.Response) (http.Header, error)
+
+var (
+	_ ContextDialer = (*httpProxy)(nil)
+	_ ContextDialer = (*socks5Proxy)(nil)
+)
+
+// 根据proxy url的scheme选择代理协议, url为nil的时候直连
+// http(默认): CONNECT
+// https: 先和proxy建立tls连接, 再CONNECT
+// socks5: 本地解析域名, socks5h: 由proxy解析域名
+func newProxyDialContext(u *url.URL, forward dialContextFunc, opt *proxyOption) (dialContextFunc, error) {
+	if u == nil {
+		return forward, nil
+	}
+
+	switch scheme := strings.ToLower(u.Scheme); scheme {
+	case "", "http", "ws", "https", "wss":
+		h := newhttpProxyContext(u, forward)
+		h.header, h.auth = opt.header, opt.auth
+		if scheme == "https" || scheme == "wss" {
+			h.tlsConfig = proxyTLSConfig(u, opt.tlsConfig)
+		}
+		return h.DialContext, nil
+	case "socks5", "socks5h":
+		return (&socks5Proxy{proxyAddr: u, dialContext: forward}).DialContext, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedProxyScheme, u.Scheme)
+}
+
+func proxyTLSConfig(u *url.URL, tlsConfig *tls.Config) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	return tlsConfig
+}
 
-func newhttpProxy(u *url.URL, dial dialFunc) *httpProxy {
-	return &httpProxy{proxyAddr: u, dialTimeout: dial}
+// proxy的地址, 没有端口的时候使用scheme的默认端口
+func proxyHostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+
+	port := "80"
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
-func (h *httpProxy) DialTimeout(network, addr string, timeout time.Duration) (c net.Conn, err error) {
-	if h.proxyAddr == nil {
-		return h.dialTimeout(network, addr, h.timeout)
+// 和http.ProxyFromEnvironment一样读取HTTP_PROXY, HTTPS_PROXY和NO_PROXY环境变量
+// ws://使用HTTP_PROXY, wss://使用HTTPS_PROXY, 代理的地址可以是http, https, socks5, socks5h
+// 每次调用都重新读取环境变量
+func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	u := *req.URL
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
 	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&u)
+}
+
+func newhttpProxyContext(u *url.URL, dial dialContextFunc) *httpProxy {
+	return &httpProxy{proxyAddr: u, dialContext: dial}
+}
 
-	hostName := hostname.GetHostName(h.proxyAddr)
-	c, err = h.dialTimeout(network, hostName, h.timeout)
+// 连接proxy, https://的时候完成tls握手
+func (h *httpProxy) dialProxy(ctx context.Context, network string) (c net.Conn, err error) {
+	c, err = h.dialContext(ctx, network, proxyHostPort(h.proxyAddr))
 	if err != nil {
 		return nil, err
 	}
 
-	header := make(http.Header)
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(c, h.tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tlsConn
+	}
+	return c, nil
+}
 
-	if u := h.proxyAddr.User; u != nil {
+// CONNECT请求的header: url里面的用户名密码, WithClientProxyConnectHeader配置的header
+func (h *httpProxy) connectHeader() http.Header {
+	header := h.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	if u := h.proxyAddr.User; u != nil && header.Get("Proxy-Authorization") == "" {
 		user := u.Username()
 		if pass, ok := u.Password(); ok {
 			credential := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
 			header.Set("Proxy-Authorization", "Basic "+credential)
 		}
 	}
+	return header
+}
 
+// 发送CONNECT请求, 读取响应, 非2xx的时候读取body
+func (h *httpProxy) connect(ctx context.Context, c net.Conn, br *bufio.Reader, addr string, header http.Header) (resp *http.Response, body []byte, err error) {
 	req := &http.Request{
 		Method: http.MethodConnect,
-		URL:    &url.URL{Opaque: hostName},
-		Host:   hostName,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
 		Header: header,
 	}
 
-	if err := req.Write(c); err != nil {
-		c.Close()
+	stop := watchContext(ctx, c)
+	defer func() {
+		if ctxErr := stop(); ctxErr != nil {
+			err = ctxErr
+		}
+	}()
+
+	if err = req.Write(c); err != nil {
+		return nil, nil, err
+	}
+
+	if resp, err = http.ReadResponse(br, req); err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxProxyErrorBody))
+		resp.Body.Close()
+	}
+	return resp, body, err
+}
+
+// ctx作用于连接proxy和CONNECT请求
+// 代理返回407并且配置了WithClientProxyAuth的时候, 带上回调返回的header重新发送CONNECT
+func (h *httpProxy) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
+	if h.proxyAddr == nil {
+		return h.dialContext(ctx, network, addr)
+	}
+
+	if c, err = h.dialProxy(ctx, network); err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil && c != nil {
+			c.Close()
+			c = nil
+		}
+	}()
 
+	header := h.connectHeader()
 	br := bufio.NewReader(c)
-	resp, err := http.ReadResponse(br, req)
-	if err != nil {
-		c.Close()
+	for round := 0; ; round++ {
+		resp, body, err := h.connect(ctx, c, br, addr, header)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode/100 == 2 {
+			break
+		}
+
+		perr := newProxyError(resp, body)
+		if resp.StatusCode != http.StatusProxyAuthRequired || h.auth == nil || round >= maxProxyAuthRounds {
+			return nil, perr
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		extra, err := h.auth(h.proxyAddr, resp)
+		if err != nil {
+			return nil, err
+		}
+		if len(extra) == 0 {
+			return nil, perr
+		}
+		for k, v := range extra {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+
+		// 代理关闭了连接, 重新连接之后再认证
+		if resp.Close {
+			c.Close()
+			if c, err = h.dialProxy(ctx, network); err != nil {
+				return nil, err
+			}
+			br.Reset(c)
+		}
+	}
+
+	if err = c.SetDeadline(time.Time{}); err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		c.Close()
-		return nil, getHttpErrMsg(resp.StatusCode)
+	// 代理在响应之后紧跟着发过来的数据已经在br里面了, 不能丢
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, br: br}, nil
 	}
 	return c, nil
 }
+
+// 把dialContextFunc转成golang.org/x/net/proxy的Dialer, 作为socks5的上一级
+type forwardDialer dialContextFunc
+
+func (f forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f forwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// ctx作用于连接proxy, 解析域名和socks5握手
+func (s *socks5Proxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if u := s.proxyAddr.User; u != nil {
+		auth = &proxy.Auth{User: u.Username()}
+		auth.Password, _ = u.Password()
+	}
+
+	d, err := proxy.SOCKS5(network, proxyHostPort(s.proxyAddr), auth, forwardDialer(s.dialContext))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(s.proxyAddr.Scheme) == "socks5" {
+		if addr, err = resolveAddr(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+	return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+}
+
+// 本地解析域名, 优先使用ipv4
+func resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	ip := ips[0].IP
+	for _, a := range ips {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// CONNECT成功之后, 先读bufio.Reader里面已经缓存的数据, 读完之后直接读net.Conn
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	if b.br != nil {
+		if b.br.Buffered() > 0 {
+			return b.br.Read(p)
+		}
+		b.br = nil
+	}
+	return b.Conn.Read(p)
+}
+
+// 代理拒绝CONNECT请求的时候返回
+// 可以用errors.Is(err, ErrProxyConnect)判断, 407的时候是ErrProxyAuthRequired
+type ProxyError struct {
+	StatusCode int         // 代理返回的状态码
+	Status     string      // 代理返回的状态行, 比如"403 Forbidden"
+	Header     http.Header // 代理返回的header, 比如Proxy-Authenticate
+	Body       []byte      // 代理返回的body, 最多读取4k
+	Err        error
+}
+
+func (e *ProxyError) Error() string {
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("%s, proxy status %s: %s", e.Err, e.Status, e.Body)
+	}
+	return fmt.Sprintf("%s, proxy status %s", e.Err, e.Status)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+func newProxyError(resp *http.Response, body []byte) *ProxyError {
+	e := &ProxyError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Body:       body,
+		Err:        ErrProxyConnect,
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		e.Err = ErrProxyAuthRequired
+	}
+	return e
+}
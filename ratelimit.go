@@ -0,0 +1,225 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/antlabs/wsutil/frame"
+)
+
+// event loop模式下frame需要等令牌, 由EventLoop.process处理, 不会返回给用户
+var errRateLimitWait = errors.New("rate limit wait")
+
+// 超过限速之后的处理方式
+type RateLimitAction int
+
+const (
+	// 使用TerminatingConnection关闭连接, 默认值
+	RateLimitClose RateLimitAction = iota
+	// 丢弃超过限速的消息, ping不会丢弃, 退化成RateLimitDelay, 保证对端的心跳能收到pong
+	// 开启压缩上下文接管的时候, 丢弃会破坏解压缩的上下文, 压缩的消息退化成RateLimitDelay
+	RateLimitDrop
+	// 暂停读取, 等令牌够了再处理, 对端会因为tcp的窗口被限速
+	// event loop模式下不占用worker, 连接交给定时器重新调度, 等待期间暂停读取fd
+	RateLimitDelay
+)
+
+// 令牌桶限速的配置, Rate <= 0的维度不限速
+// Burst是桶的容量, <= 0的时候是1秒的量
+type RateLimit struct {
+	MessagesPerSec float64 // 每秒text和binary消息的个数
+	MessageBurst   int
+	BytesPerSec    float64 // 每秒数据帧payload的字节数(解压之前)
+	ByteBurst      int
+	ControlPerSec  float64 // 每秒ping的个数, pong和close不限速, 丢掉pong会让心跳误判超时
+	ControlBurst   int
+	Action         RateLimitAction
+}
+
+// 限速的统计数据
+type RateLimitStats struct {
+	Exceeded  uint64        // 超过限速的次数
+	Dropped   uint64        // 丢弃的frame个数
+	Delayed   uint64        // 暂停读取的次数
+	DelayTime time.Duration // 暂停读取的总时间
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	b := tokenBucket{rate: rate, burst: float64(burst)}
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	return b
+}
+
+// 令牌够n个返回0, 否则返回需要等待的时间
+// 比桶的容量还大的frame, 桶满了就可以通过, 欠的令牌由后面的frame等待还清
+func (b *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// 每个连接的限速状态, 只在读go程(或者event loop的worker)里面使用
+type rateLimiter struct {
+	conf     *RateLimit
+	messages tokenBucket
+	bytes    tokenBucket
+	control  tokenBucket
+	dropping bool          // 正在丢弃一个分段的消息
+	waiting  bool          // event loop模式下有frame在等令牌, 重新处理的时候不再统计
+	wait     time.Duration // event loop模式下需要等待的时间
+
+	exceeded  uint64
+	dropped   uint64
+	delayed   uint64
+	delayTime int64
+}
+
+func newRateLimiter(conf *RateLimit) *rateLimiter {
+	return &rateLimiter{
+		conf:     conf,
+		messages: newTokenBucket(conf.MessagesPerSec, conf.MessageBurst),
+		bytes:    newTokenBucket(conf.BytesPerSec, conf.ByteBurst),
+		control:  newTokenBucket(conf.ControlPerSec, conf.ControlBurst),
+	}
+}
+
+// 限速的统计数据, 没有配置WithServerRateLimit的时候都是0
+func (c *Conn) RateLimitStats() (s RateLimitStats) {
+	if l := c.rl; l != nil {
+		s.Exceeded = atomic.LoadUint64(&l.exceeded)
+		s.Dropped = atomic.LoadUint64(&l.dropped)
+		s.Delayed = atomic.LoadUint64(&l.delayed)
+		s.DelayTime = time.Duration(atomic.LoadInt64(&l.delayTime))
+	}
+	return s
+}
+
+// 处理frame之前检查限速, skip为true的时候丢弃这个frame
+func (c *Conn) rateLimitFrame(f *frame.Frame2) (skip bool, err error) {
+	l := c.rl
+	if l == nil || f.Opcode == Close || f.Opcode == Pong {
+		return false, nil
+	}
+
+	if f.Opcode == Continuation && l.dropping {
+		if f.GetFin() {
+			l.dropping = false
+		}
+		atomic.AddUint64(&l.dropped, 1)
+		return true, nil
+	}
+
+	var buckets [2]*tokenBucket
+	var costs [2]float64
+	switch {
+	case f.Opcode.IsControl():
+		buckets[0], costs[0] = &l.control, 1
+	case f.Opcode == Continuation:
+		buckets[0], costs[0] = &l.bytes, float64(f.PayloadLen)
+	default:
+		buckets[0], costs[0] = &l.messages, 1
+		buckets[1], costs[1] = &l.bytes, float64(f.PayloadLen)
+	}
+
+	// 消息中间的分段, ping和压缩上下文接管的消息不能丢弃
+	action := l.conf.Action
+	if action == RateLimitDrop && (f.Opcode == Continuation || f.Opcode == Ping || f.GetRsv1() && c.decompressTakeover()) {
+		action = RateLimitDelay
+	}
+
+	for exceeded := l.waiting; ; exceeded = true {
+		var wait time.Duration
+		now := time.Now()
+		for i, b := range buckets {
+			if b != nil {
+				if w := b.wait(now, costs[i]); w > wait {
+					wait = w
+				}
+			}
+		}
+
+		if wait == 0 {
+			l.waiting = false
+			for i, b := range buckets {
+				if b != nil {
+					b.take(costs[i])
+				}
+			}
+			return false, nil
+		}
+
+		if !exceeded {
+			atomic.AddUint64(&l.exceeded, 1)
+		}
+
+		switch action {
+		case RateLimitDrop:
+			atomic.AddUint64(&l.dropped, 1)
+			if !f.GetFin() {
+				l.dropping = true
+			}
+			return true, nil
+		case RateLimitDelay:
+			atomic.AddUint64(&l.delayed, 1)
+			atomic.AddInt64(&l.delayTime, int64(wait))
+			// event loop的worker是所有连接共用的, 不能sleep
+			if c.elc != nil {
+				l.waiting, l.wait = true, wait
+				return false, errRateLimitWait
+			}
+			time.Sleep(wait)
+		default:
+			return false, c.writeErrAndOnClose(TerminatingConnection, ErrRateLimited)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rateLimitServer struct {
+	*httptest.Server
+	conns  chan *Conn
+	msgs   chan []byte
+	closed chan error
+}
+
+func newRateLimitServer(t *testing.T, rl RateLimit) *rateLimitServer {
+	s := &rateLimitServer{conns: make(chan *Conn, 1), msgs: make(chan []byte, 100), closed: make(chan error, 1)}
+	s.Server = newWSServer(t, func(c *Conn) {
+		s.conns <- c
+		c.ReadLoop()
+	}, WithServerRateLimit(rl), WithServerReplyPing(), WithServerCallbackFunc(nil, func(c *Conn, op Opcode, payload []byte) {
+		if op == Text || op == Binary {
+			s.msgs <- append([]byte(nil), payload...)
+		}
+	}, func(c *Conn, err error) {
+		s.closed <- err
+	}))
+	return s
+}
+
+func (s *rateLimitServer) dial(t *testing.T, opts ...ClientOption) *Conn {
+	c, err := Dial(HTTPToWS(s.URL), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_RateLimit(t *testing.T) {
+	t.Run("close on ping flood", func(t *testing.T) {
+		s := newRateLimitServer(t, RateLimit{ControlPerSec: 10, ControlBurst: 5})
+		defer s.Close()
+
+		c := s.dial(t)
+		defer c.Close()
+		go c.ReadLoop()
+
+		for i := 0; i < 50; i++ {
+			if err := c.WritePing([]byte("flood")); err != nil {
+				break
+			}
+		}
+
+		select {
+		case err := <-s.closed:
+			if !errors.Is(err, ErrRateLimited) {
+				t.Fatalf("got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("server OnClose timeout")
+		}
+
+		if st := (<-s.conns).RateLimitStats(); st.Exceeded != 1 {
+			t.Fatalf("got %+v", st)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		s := newRateLimitServer(t, RateLimit{MessagesPerSec: 0.1, MessageBurst: 2, Action: RateLimitDrop})
+		defer s.Close()
+
+		c := s.dial(t)
+		defer c.Close()
+
+		for i := 0; i < 5; i++ {
+			if err := c.WriteMessage(Text, []byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 分段的消息整个丢弃
+		if err := c.writeFragment(Binary, []byte(strings.Repeat("a", 30)), 10); err != nil {
+			t.Fatal(err)
+		}
+		// 控制帧不受消息数的限制
+		if err := c.WriteMessage(Close, NormalClosure.toBytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		<-s.closed
+		if n := len(s.msgs); n != 2 {
+			t.Fatalf("got %d messages", n)
+		}
+		st := (<-s.conns).RateLimitStats()
+		if st.Exceeded != 4 || st.Dropped != 6 {
+			t.Fatalf("got %+v", st)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		s := newRateLimitServer(t, RateLimit{BytesPerSec: 1000, ByteBurst: 100, Action: RateLimitDelay})
+		defer s.Close()
+
+		c := s.dial(t)
+		defer c.Close()
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := c.WriteMessage(Binary, make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-s.msgs:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout %d", i)
+			}
+		}
+
+		// 第一个消息用完了桶, 后面两个各等100ms
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Fatalf("not delayed: %s", d)
+		}
+		if st := (<-s.conns).RateLimitStats(); st.Delayed == 0 || st.Dropped != 0 {
+			t.Fatalf("got %+v", st)
+		}
+	})
+
+	t.Run("delay event loop", func(t *testing.T) {
+		// 只有一个worker, 等令牌的连接不能挡住其他连接
+		el, err := NewEventLoop(WithEventLoopWorkers(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer el.Close()
+
+		conns := make(chan *Conn, 2)
+		msgs := make(chan string, 10)
+		ts := newWSServer(t, func(c *Conn) {
+			conns <- c
+			c.StartReadLoop()
+		},
+			WithServerEventLoop(el),
+			WithServerRateLimit(RateLimit{BytesPerSec: 1000, ByteBurst: 100, Action: RateLimitDelay}),
+			WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				msgs <- string(payload[:1])
+			}))
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		slow, err := Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slow.Close()
+		fast, err := Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fast.Close()
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := slow.WriteMessage(Binary, []byte(strings.Repeat("s", 100))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := fast.WriteMessage(Binary, []byte("f")); err != nil {
+			t.Fatal(err)
+		}
+
+		var got string
+		for i := 0; i < 4; i++ {
+			select {
+			case m := <-msgs:
+				got += m
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout %d", i)
+			}
+		}
+
+		// 第一个消息用完了桶, 后面两个各等100ms, 这期间fast的消息先处理
+		if got != "sfss" {
+			t.Fatalf("got %s", got)
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Fatalf("not delayed: %s", d)
+		}
+		st := (<-conns).RateLimitStats()
+		if st2 := (<-conns).RateLimitStats(); st2.Delayed > st.Delayed {
+			st = st2
+		}
+		if st.Delayed != 2 || st.Exceeded != 2 {
+			t.Fatalf("got %+v", st)
+		}
+	})
+
+	t.Run("delay event loop memory", func(t *testing.T) {
+		el, err := NewEventLoop(WithEventLoopEdgeTriggered())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer el.Close()
+
+		conns := make(chan *Conn, 1)
+		ts := newWSServer(t, func(c *Conn) {
+			c.StartReadLoop()
+			conns <- c
+		},
+			WithServerEventLoop(el),
+			WithServerRateLimit(RateLimit{BytesPerSec: 1000, ByteBurst: 1000, Action: RateLimitDelay}))
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		sc := <-conns
+
+		// 对端一直发送, 被限速之后会阻塞在tcp的窗口上
+		const total = 64 << 20
+		sent := make(chan int, 1)
+		go func() {
+			n := 0
+			msg := make([]byte, 64*1024)
+			for n < total {
+				if err := c.WriteTimeout(Binary, msg, time.Second); err != nil {
+					break
+				}
+				n += len(msg)
+			}
+			sent <- n
+		}()
+
+		time.Sleep(300 * time.Millisecond)
+		e := sc.elc
+		if e == nil {
+			t.Skip("event loop not supported")
+		}
+		e.mu.Lock()
+		buffered := len(e.in)
+		e.mu.Unlock()
+		if buffered > 1<<20 {
+			t.Fatalf("server buffered %d bytes during delay", buffered)
+		}
+		if n := <-sent; n >= total {
+			t.Fatalf("client was not throttled, sent %d bytes", n)
+		}
+	})
+}
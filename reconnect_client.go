@@ -0,0 +1,329 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 断线期间写数据的处理策略
+type ReconnectWritePolicy int
+
+const (
+	// 断线期间直接返回ErrDisconnected
+	ReconnectWriteReject ReconnectWritePolicy = iota
+	// 断线期间缓存起来, 重连成功之后按顺序发送
+	ReconnectWriteQueue
+)
+
+const (
+	defaultReconnectMinBackoff = 500 * time.Millisecond
+	defaultReconnectMaxBackoff = 30 * time.Second
+	defaultReconnectFactor     = 2.0
+	defaultReconnectJitter     = 0.2
+	defaultReconnectQueueSize  = 1024
+)
+
+type ReconnectOption func(*ReconnectingClient)
+
+// 断线期间缓存的消息
+type queuedMessage struct {
+	op   Opcode
+	data []byte
+}
+
+// 自动重连的客户端
+// 连接断开(ReadLoop返回)之后, 按指数退避+抖动的间隔重新Dial, 回调还是使用DialOption里面配置的Callback
+type ReconnectingClient struct {
+	rawUrl       string
+	conf         *DialOption
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	factor       float64
+	jitter       float64
+	maxRetries   int // 连续重连失败的最大次数, 0表示不限制
+	onReconnect  func(*Conn)
+	onDisconnect func(*Conn, error)
+	writePolicy  ReconnectWritePolicy
+	queueSize    int
+
+	mu     sync.Mutex
+	conn   *Conn // 断线期间为nil
+	queue  []queuedMessage
+	closed bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// 1.配置退避时间, 第一次重连等待min, 之后每次乘以factor, 最大不超过max
+func WithReconnectBackoff(min, max time.Duration, factor float64) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		if min > 0 {
+			r.minBackoff = min
+		}
+		if max >= r.minBackoff {
+			r.maxBackoff = max
+		}
+		if factor >= 1.0 {
+			r.factor = factor
+		}
+	}
+}
+
+// 2.配置抖动的比例, 0.2表示在退避时间上下浮动20%
+func WithReconnectJitter(jitter float64) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		if jitter >= 0 && jitter <= 1 {
+			r.jitter = jitter
+		}
+	}
+}
+
+// 3.配置连续重连失败的最大次数, 超过之后不再重连, 默认不限制
+func WithReconnectMaxRetries(n int) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		r.maxRetries = n
+	}
+}
+
+// 4.重连成功之后的回调, 可以在这里重新订阅
+// 在缓存的消息发送之前调用
+func WithOnReconnect(f func(*Conn)) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		r.onReconnect = f
+	}
+}
+
+// 5.连接断开之后的回调, err是ReadLoop返回的错误
+func WithOnDisconnect(f func(*Conn, error)) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		r.onDisconnect = f
+	}
+}
+
+// 6.配置断线期间写数据的处理策略, queueSize只在ReconnectWriteQueue时有效
+func WithReconnectWritePolicy(policy ReconnectWritePolicy, queueSize int) ReconnectOption {
+	return func(r *ReconnectingClient) {
+		r.writePolicy = policy
+		if queueSize > 0 {
+			r.queueSize = queueSize
+		}
+	}
+}
+
+// 第一次连接失败直接返回错误, 连接成功之后会在后台go程里面运行ReadLoop
+func DialReconnecting(ctx context.Context, rawUrl string, conf *DialOption, opts ...ReconnectOption) (*ReconnectingClient, error) {
+	r := &ReconnectingClient{
+		rawUrl:     rawUrl,
+		conf:       conf,
+		minBackoff: defaultReconnectMinBackoff,
+		maxBackoff: defaultReconnectMaxBackoff,
+		factor:     defaultReconnectFactor,
+		jitter:     defaultReconnectJitter,
+		queueSize:  defaultReconnectQueueSize,
+		done:       make(chan struct{}),
+	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	c, err := r.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.conn = c
+	go r.run(c)
+	return r, nil
+}
+
+// 每次Dial都使用一份新的配置, handshake会往Header里面追加数据
+func (r *ReconnectingClient) dial(ctx context.Context) (*Conn, error) {
+	conf := *r.conf
+	conf.Header = r.conf.Header.Clone()
+	return DialConfContext(ctx, r.rawUrl, &conf)
+}
+
+func (r *ReconnectingClient) run(c *Conn) {
+	defer close(r.done)
+	for {
+		err := c.ReadLoop()
+
+		r.mu.Lock()
+		r.conn = nil
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+
+		if r.onDisconnect != nil {
+			r.onDisconnect(c, err)
+		}
+
+		if c = r.redial(); c == nil {
+			return
+		}
+	}
+}
+
+// 计算下次的退避时间
+func (r *ReconnectingClient) nextBackoff(backoff time.Duration) time.Duration {
+	backoff = time.Duration(float64(backoff) * r.factor)
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	return backoff
+}
+
+func (r *ReconnectingClient) withJitter(backoff time.Duration) time.Duration {
+	if r.jitter == 0 {
+		return backoff
+	}
+	delta := (rand.Float64()*2 - 1) * r.jitter * float64(backoff)
+	return backoff + time.Duration(delta)
+}
+
+// 重连直到成功, 返回nil表示已经关闭或者重试次数用完
+func (r *ReconnectingClient) redial() *Conn {
+	backoff := r.minBackoff
+	for retries := 1; r.maxRetries <= 0 || retries <= r.maxRetries; retries++ {
+		tm := time.NewTimer(r.withJitter(backoff))
+		select {
+		case <-tm.C:
+		case <-r.ctx.Done():
+			tm.Stop()
+			return nil
+		}
+
+		c, err := r.dial(r.ctx)
+		if err != nil {
+			backoff = r.nextBackoff(backoff)
+			continue
+		}
+
+		if r.onReconnect != nil {
+			r.onReconnect(c)
+		}
+
+		if !r.flushQueue(c) {
+			c.Close()
+			return nil
+		}
+		return c
+	}
+
+	// 重试次数用完
+	r.mu.Lock()
+	r.closed = true
+	r.queue = nil
+	r.mu.Unlock()
+	return nil
+}
+
+// 发送断线期间缓存的消息, 发送完之后才设置conn, 保证消息的顺序
+func (r *ReconnectingClient) flushQueue(c *Conn) bool {
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return false
+		}
+
+		queue := r.queue
+		r.queue = nil
+		if len(queue) == 0 {
+			r.conn = c
+			r.mu.Unlock()
+			return true
+		}
+		r.mu.Unlock()
+
+		for i, m := range queue {
+			if err := c.WriteMessage(m.op, m.data); err != nil {
+				// 没有发送出去的消息放回队列, 等下一次重连
+				r.mu.Lock()
+				r.queue = append(queue[i:], r.queue...)
+				r.mu.Unlock()
+				return true
+			}
+		}
+	}
+}
+
+// 返回当前的连接, 断线期间返回nil
+func (r *ReconnectingClient) Conn() *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+// 写消息, 断线期间按照WithReconnectWritePolicy配置的策略处理
+func (r *ReconnectingClient) WriteMessage(op Opcode, data []byte) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+
+	c := r.conn
+	if c == nil {
+		defer r.mu.Unlock()
+		if r.writePolicy != ReconnectWriteQueue {
+			return ErrDisconnected
+		}
+
+		if len(r.queue) >= r.queueSize {
+			return ErrReconnectQueueFull
+		}
+
+		r.queue = append(r.queue, queuedMessage{op: op, data: append([]byte(nil), data...)})
+		return nil
+	}
+	r.mu.Unlock()
+
+	return c.WriteMessage(op, data)
+}
+
+// 关闭当前连接并停止重连, 缓存的消息会被丢弃
+// Close不会等待后台go程退出, 需要等待的话可以使用Done
+func (r *ReconnectingClient) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	c := r.conn
+	r.queue = nil
+	r.mu.Unlock()
+
+	r.cancel()
+	if c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// 后台go程退出之后, 返回的chan会被关闭
+func (r *ReconnectingClient) Done() <-chan struct{} {
+	return r.done
+}
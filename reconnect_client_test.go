@@ -0,0 +1,139 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 第一个连接收到消息之后关闭, 后面的连接把收到的消息发到chan里面
+func newReconnectServer(t *testing.T, got chan string) *httptest.Server {
+	var count int32
+	return newWSServer(t, func(c *Conn) {
+		c.SetSession(atomic.AddInt32(&count, 1) == 1)
+		_ = c.ReadLoop()
+	}, WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+		if first, _ := c.Session().(bool); first {
+			c.Close()
+			return
+		}
+		got <- string(payload)
+	}))
+}
+
+func Test_ReconnectingClient(t *testing.T) {
+	t.Run("reconnect and queue", func(t *testing.T) {
+		got := make(chan string, 2)
+		ts := newReconnectServer(t, got)
+		defer ts.Close()
+
+		disconnected := make(chan struct{}, 1)
+		url := HTTPToWS(ts.URL)
+		rc, err := DialReconnecting(context.Background(), url, ClientOptionToConf(),
+			WithReconnectBackoff(50*time.Millisecond, time.Second, 2),
+			WithReconnectWritePolicy(ReconnectWriteQueue, 10),
+			WithOnDisconnect(func(c *Conn, err error) {
+				disconnected <- struct{}{}
+			}),
+			WithOnReconnect(func(c *Conn) {
+				if err := c.WriteMessage(Text, []byte("subscribe")); err != nil {
+					t.Error(err)
+				}
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		if err = rc.WriteMessage(Text, []byte("close me")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+
+		// 断线期间写入, 重连之后发送
+		if err = rc.WriteMessage(Text, []byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, need := range []string{"subscribe", "queued"} {
+			select {
+			case d := <-got:
+				if d != need {
+					t.Errorf("got %s, need %s", d, need)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		got := make(chan string, 1)
+		ts := newReconnectServer(t, got)
+		defer ts.Close()
+
+		disconnected := make(chan struct{}, 1)
+		url := HTTPToWS(ts.URL)
+		rc, err := DialReconnecting(context.Background(), url, ClientOptionToConf(),
+			WithReconnectBackoff(time.Second, time.Second, 1),
+			WithOnDisconnect(func(c *Conn, err error) {
+				disconnected <- struct{}{}
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = rc.WriteMessage(Text, []byte("close me")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+
+		if err = rc.WriteMessage(Text, []byte("hello")); !errors.Is(err, ErrDisconnected) {
+			t.Errorf("got %v, need %v", err, ErrDisconnected)
+		}
+
+		rc.Close()
+		select {
+		case <-rc.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Close did not stop the client")
+		}
+
+		if err = rc.WriteMessage(Text, []byte("hello")); !errors.Is(err, ErrClosed) {
+			t.Errorf("got %v, need %v", err, ErrClosed)
+		}
+	})
+
+	t.Run("first dial fail", func(t *testing.T) {
+		_, err := DialReconnecting(context.Background(), "ws://127.0.0.1:1", ClientOptionToConf())
+		if err == nil {
+			t.Error("need error")
+		}
+	})
+}
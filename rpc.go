@@ -0,0 +1,564 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// JSON-RPC 2.0预定义的错误码
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+const (
+	rpcVersion            = "2.0"
+	rpcDefaultConcurrency = 64  // 每个连接同时执行的请求数
+	rpcDefaultMaxBatch    = 128 // 批量请求最多的元素个数
+)
+
+// JSON-RPC 2.0的错误对象, handler返回*RPCError的时候原样发给对端
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// 请求, 通知和响应共用一个结构
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+func (m *rpcMessage) isRequest() bool {
+	return m.Method != ""
+}
+
+// 通知没有id, 不需要响应
+func (m *rpcMessage) isNotification() bool {
+	return len(m.ID) == 0
+}
+
+type rpcHandler func(ctx context.Context, c *Conn, params json.RawMessage) (any, error)
+
+// 服务端的方法表, 可以被多个连接共享
+type RPCRegistry struct {
+	mu      sync.RWMutex
+	methods map[string]rpcHandler
+}
+
+func NewRPCRegistry() *RPCRegistry {
+	return &RPCRegistry{methods: make(map[string]rpcHandler)}
+}
+
+// 注册方法, params解码失败的时候返回RPCInvalidParams, 没有params的时候是P的零值
+// fn返回的error不是*RPCError的时候, 使用RPCInternalError
+// ctx在连接关闭的时候取消
+func RegisterRPC[P, R any](reg *RPCRegistry, method string, fn func(ctx context.Context, c *Conn, params P) (R, error)) {
+	h := func(ctx context.Context, c *Conn, raw json.RawMessage) (any, error) {
+		var p P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &p); err != nil {
+				return nil, &RPCError{Code: RPCInvalidParams, Message: err.Error()}
+			}
+		}
+		return fn(ctx, c, p)
+	}
+
+	reg.mu.Lock()
+	reg.methods[method] = h
+	reg.mu.Unlock()
+}
+
+func (reg *RPCRegistry) lookup(method string) rpcHandler {
+	if reg == nil {
+		return nil
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.methods[method]
+}
+
+// 一个连接上的JSON-RPC 2.0, 两端都可以调用对方的方法
+// 实现了Callback, 替换掉连接原来的回调, text消息按JSON-RPC处理, 其他的消息和连接的事件交给原来的回调
+type RPC struct {
+	c       *Conn
+	cb      Callback
+	reg     *RPCRegistry
+	ctx     context.Context // 连接关闭的时候取消, 传给handler
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	sem        chan struct{}    // 限制同时执行的请求和批量请求
+	maxBatch   int              // 批量请求最多的元素个数
+	notifies   chan *rpcMessage // 通知在一个go程里面按顺序执行
+	notifyOnce sync.Once
+
+	mu       sync.Mutex
+	nextID   uint64
+	pending  map[uint64]chan *rpcMessage
+	closeErr error // 连接关闭的错误, 之后的Call都返回这个错误
+}
+
+// 在连接上使用JSON-RPC, 需要在ReadLoop之前调用, reg为nil的时候只能调用对端, 对端的请求返回RPCMethodNotFound
+func NewRPC(c *Conn, reg *RPCRegistry) *RPC {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RPC{
+		c:        c,
+		cb:       c.Callback,
+		reg:      reg,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[uint64]chan *rpcMessage),
+		sem:      make(chan struct{}, rpcDefaultConcurrency),
+		maxBatch: rpcDefaultMaxBatch,
+		notifies: make(chan *rpcMessage, rpcDefaultConcurrency),
+	}
+	c.Callback = r
+	return r
+}
+
+// 设置同时执行的请求数(默认64)和批量请求最多的元素个数(默认128), 需要在ReadLoop之前调用
+// 请求数到了上限之后暂停读取, 等有请求执行完再继续
+// 超过maxBatch的批量请求返回RPCInvalidRequest, <= 0的值不修改
+func (r *RPC) SetLimit(concurrency, maxBatch int) {
+	if concurrency > 0 {
+		r.sem = make(chan struct{}, concurrency)
+		r.notifies = make(chan *rpcMessage, concurrency)
+	}
+	if maxBatch > 0 {
+		r.maxBatch = maxBatch
+	}
+}
+
+// 设置Call默认的超时时间, ctx的deadline更早的时候使用ctx的, 0表示不超时
+func (r *RPC) SetTimeout(d time.Duration) {
+	r.mu.Lock()
+	r.timeout = d
+	r.mu.Unlock()
+}
+
+// 底层的连接
+func (r *RPC) Conn() *Conn {
+	return r.c
+}
+
+func (r *RPC) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return r.c.WriteMessage(opcode.Text, data)
+}
+
+// 分配id和等待响应的chan
+func (r *RPC) register() (id uint64, done chan *rpcMessage, timeout time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closeErr != nil {
+		return 0, nil, 0, r.closeErr
+	}
+	r.nextID++
+	id = r.nextID
+	done = make(chan *rpcMessage, 1)
+	r.pending[id] = done
+	return id, done, r.timeout, nil
+}
+
+func (r *RPC) unregister(id uint64) {
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+}
+
+func newRPCRequest(id uint64, method string, params any) (*rpcMessage, error) {
+	m := &rpcMessage{JSONRPC: rpcVersion, Method: method}
+	if id != 0 {
+		m.ID = json.RawMessage(strconv.FormatUint(id, 10))
+	}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		m.Params = raw
+	}
+	return m, nil
+}
+
+// 等待响应, 超时或者ctx取消的时候返回ctx的错误, 连接关闭的时候返回关闭的错误
+func (r *RPC) wait(ctx context.Context, done chan *rpcMessage, timeout time.Duration) (*rpcMessage, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case m := <-done:
+		if m == nil {
+			r.mu.Lock()
+			err := r.closeErr
+			r.mu.Unlock()
+			return nil, err
+		}
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 解码响应, 对端返回错误的时候是*RPCError
+func decodeRPCResult(m *rpcMessage, result any) error {
+	if m.Error != nil {
+		return m.Error
+	}
+	if result == nil || len(m.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Result, result)
+}
+
+// 调用对端的方法, result是指针, 不关心结果的时候可以传nil
+// ctx取消, 超时, 连接关闭的时候返回对应的错误, 之后收到的响应会被丢弃
+func (r *RPC) Call(ctx context.Context, method string, params any, result any) error {
+	id, done, timeout, err := r.register()
+	if err != nil {
+		return err
+	}
+	defer r.unregister(id)
+
+	req, err := newRPCRequest(id, method, params)
+	if err != nil {
+		return err
+	}
+	if err = r.write(req); err != nil {
+		return err
+	}
+
+	m, err := r.wait(ctx, done, timeout)
+	if err != nil {
+		return err
+	}
+	return decodeRPCResult(m, result)
+}
+
+// 发送通知, 对端不会响应
+func (r *RPC) Notify(method string, params any) error {
+	r.mu.Lock()
+	err := r.closeErr
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	req, err := newRPCRequest(0, method, params)
+	if err != nil {
+		return err
+	}
+	return r.write(req)
+}
+
+// 批量调用的一个元素
+type BatchElem struct {
+	Method string
+	Params any
+	Result any   // 指针, 可以是nil
+	Notify bool  // 通知, 没有响应
+	Error  error // 这个调用的错误, 比如*RPCError
+}
+
+// 批量调用, 所有的请求放在一个消息里面发送
+// 返回的error是发送或者等待的错误, 每个调用的错误在BatchElem.Error里面
+func (r *RPC) BatchCall(ctx context.Context, batch []BatchElem) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	reqs := make([]*rpcMessage, len(batch))
+	ids := make([]uint64, len(batch))
+	dones := make([]chan *rpcMessage, len(batch))
+	var timeout time.Duration
+	defer func() {
+		for _, id := range ids {
+			if id != 0 {
+				r.unregister(id)
+			}
+		}
+	}()
+
+	for i := range batch {
+		var err error
+		if !batch[i].Notify {
+			if ids[i], dones[i], timeout, err = r.register(); err != nil {
+				return err
+			}
+		}
+		if reqs[i], err = newRPCRequest(ids[i], batch[i].Method, batch[i].Params); err != nil {
+			return err
+		}
+	}
+	if err := r.write(reqs); err != nil {
+		return err
+	}
+
+	// 所有的调用共用一个超时
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	for i := range batch {
+		if dones[i] == nil {
+			continue
+		}
+		m, err := r.wait(ctx, dones[i], 0)
+		if err != nil {
+			return err
+		}
+		batch[i].Error = decodeRPCResult(m, batch[i].Result)
+	}
+	return nil
+}
+
+func (r *RPC) OnOpen(c *Conn) {
+	r.cb.OnOpen(c)
+}
+
+// text消息按JSON-RPC处理, 请求在新的go程里面执行, handler里面可以调用对端的方法
+// 同时执行的请求数有上限, 通知按收到的顺序执行
+func (r *RPC) OnMessage(c *Conn, op Opcode, payload []byte) {
+	if op != opcode.Text {
+		r.cb.OnMessage(c, op, payload)
+		return
+	}
+
+	data := bytes.TrimSpace(payload)
+	if len(data) > 0 && data[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			r.writeError(nil, RPCParseError, err.Error())
+			return
+		}
+		if len(elems) == 0 {
+			r.writeError(nil, RPCInvalidRequest, "empty batch")
+			return
+		}
+		if len(elems) > r.maxBatch {
+			r.writeError(nil, RPCInvalidRequest, "batch too large")
+			return
+		}
+
+		var reqs []*rpcMessage
+		for _, elem := range elems {
+			// 格式不对的元素是nil, 单独返回RPCInvalidRequest, 不影响其他的元素
+			var m *rpcMessage
+			if err := json.Unmarshal(elem, &m); err != nil {
+				m = nil
+			}
+			if m == nil || m.isRequest() || m.JSONRPC != rpcVersion {
+				reqs = append(reqs, m)
+				continue
+			}
+			r.onResponse(m)
+		}
+		if len(reqs) > 0 && r.acquire() {
+			go func() {
+				defer r.release()
+				r.serveBatch(reqs)
+			}()
+		}
+		return
+	}
+
+	var m rpcMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		r.writeError(nil, RPCParseError, err.Error())
+		return
+	}
+	if !m.isRequest() && m.JSONRPC == rpcVersion {
+		r.onResponse(&m)
+		return
+	}
+
+	if m.isRequest() && m.isNotification() && m.JSONRPC == rpcVersion {
+		r.notify(&m)
+		return
+	}
+	if r.acquire() {
+		go func() {
+			defer r.release()
+			if rsp := r.serve(&m); rsp != nil {
+				_ = r.write(rsp)
+			}
+		}()
+	}
+}
+
+// 拿到执行的名额, 连接关闭的时候返回false
+func (r *RPC) acquire() bool {
+	select {
+	case r.sem <- struct{}{}:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func (r *RPC) release() {
+	<-r.sem
+}
+
+// 通知放到队列里面, 由一个go程按顺序执行, 队列满了的时候暂停读取
+func (r *RPC) notify(m *rpcMessage) {
+	r.notifyOnce.Do(func() {
+		go r.serveNotifies()
+	})
+	select {
+	case r.notifies <- m:
+	case <-r.ctx.Done():
+	}
+}
+
+func (r *RPC) serveNotifies() {
+	for {
+		select {
+		case m := <-r.notifies:
+			r.serve(m)
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// 响应交给等待的Call, 已经超时或者取消的直接丢弃
+func (r *RPC) onResponse(m *rpcMessage) {
+	id, err := strconv.ParseUint(string(m.ID), 10, 64)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	done := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if done != nil {
+		done <- m
+	}
+}
+
+func (r *RPC) writeError(id json.RawMessage, code int, msg string) {
+	_ = r.write(r.errorResponse(id, code, msg))
+}
+
+func (r *RPC) errorResponse(id json.RawMessage, code int, msg string) *rpcMessage {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcMessage{JSONRPC: rpcVersion, ID: id, Error: &RPCError{Code: code, Message: msg}}
+}
+
+// 执行一个请求, 通知返回nil
+func (r *RPC) serve(m *rpcMessage) *rpcMessage {
+	if m == nil || m.JSONRPC != rpcVersion || m.Method == "" {
+		var id json.RawMessage
+		if m != nil {
+			id = m.ID
+		}
+		return r.errorResponse(id, RPCInvalidRequest, "invalid request")
+	}
+
+	h := r.reg.lookup(m.Method)
+	if h == nil {
+		if m.isNotification() {
+			return nil
+		}
+		return r.errorResponse(m.ID, RPCMethodNotFound, "method not found: "+m.Method)
+	}
+
+	result, err := h(r.ctx, r.c, m.Params)
+	if m.isNotification() {
+		return nil
+	}
+	if err != nil {
+		var rerr *RPCError
+		if !errors.As(err, &rerr) {
+			rerr = &RPCError{Code: RPCInternalError, Message: err.Error()}
+		}
+		return &rpcMessage{JSONRPC: rpcVersion, ID: m.ID, Error: rerr}
+	}
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return r.errorResponse(m.ID, RPCInternalError, err.Error())
+	}
+	return &rpcMessage{JSONRPC: rpcVersion, ID: m.ID, Result: raw}
+}
+
+// 批量请求按顺序执行, 响应放在一个消息里面, 全部是通知的时候不响应
+func (r *RPC) serveBatch(reqs []*rpcMessage) {
+	var rsps []*rpcMessage
+	for _, m := range reqs {
+		if rsp := r.serve(m); rsp != nil {
+			rsps = append(rsps, rsp)
+		}
+	}
+	if len(rsps) > 0 {
+		_ = r.write(rsps)
+	}
+}
+
+// 连接关闭, 等待中的Call返回关闭的错误, 再调用连接原来的OnClose
+func (r *RPC) OnClose(c *Conn, err error) {
+	closeErr := err
+	if closeErr == nil {
+		closeErr = ErrClosed
+	}
+
+	r.mu.Lock()
+	if r.closeErr == nil {
+		r.closeErr = closeErr
+	}
+	pending := r.pending
+	r.pending = make(map[uint64]chan *rpcMessage)
+	r.mu.Unlock()
+
+	r.cancel()
+	for _, done := range pending {
+		close(done)
+	}
+	r.cb.OnClose(c, err)
+}
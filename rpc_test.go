@@ -0,0 +1,329 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type addParams struct {
+	A, B int
+}
+
+// 连接上使用reg提供JSON-RPC服务
+func serveRPC(reg *RPCRegistry, setup ...func(*RPC)) func(c *Conn) {
+	return func(c *Conn) {
+		rpc := NewRPC(c, reg)
+		for _, f := range setup {
+			f(rpc)
+		}
+		_ = c.ReadLoop()
+	}
+}
+
+func dialRPC(t *testing.T, ts *httptest.Server, reg *RPCRegistry) *RPC {
+	c, err := Dial(HTTPToWS(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRPC(c, reg)
+	go func() { _ = c.ReadLoop() }()
+	t.Cleanup(func() { c.Close() })
+	return r
+}
+
+func Test_RPC(t *testing.T) {
+	notified := make(chan string, 4)
+	reg := NewRPCRegistry()
+	RegisterRPC(reg, "add", func(ctx context.Context, c *Conn, p addParams) (int, error) {
+		return p.A + p.B, nil
+	})
+	RegisterRPC(reg, "fail", func(ctx context.Context, c *Conn, p any) (any, error) {
+		return nil, &RPCError{Code: 1000, Message: "fail"}
+	})
+	RegisterRPC(reg, "oops", func(ctx context.Context, c *Conn, p any) (any, error) {
+		return nil, errors.New("oops")
+	})
+	RegisterRPC(reg, "log", func(ctx context.Context, c *Conn, msg string) (any, error) {
+		notified <- msg
+		return nil, nil
+	})
+	RegisterRPC(reg, "sleep", func(ctx context.Context, c *Conn, d time.Duration) (any, error) {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+		return nil, nil
+	})
+	seq := make(chan int, 100)
+	RegisterRPC(reg, "seq", func(ctx context.Context, c *Conn, n int) (any, error) {
+		seq <- n
+		return nil, nil
+	})
+	var running, maxRunning int32
+	RegisterRPC(reg, "busy", func(ctx context.Context, c *Conn, p any) (any, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			old := atomic.LoadInt32(&maxRunning)
+			if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil, nil
+	})
+	ts := newWSServer(t, serveRPC(reg))
+
+	t.Run("call", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		var sum int
+		if err := r.Call(context.Background(), "add", addParams{A: 1, B: 2}, &sum); err != nil {
+			t.Fatal(err)
+		}
+		if sum != 3 {
+			t.Fatalf("sum = %d", sum)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		var rerr *RPCError
+		for method, code := range map[string]int{
+			"fail":    1000,
+			"oops":    RPCInternalError,
+			"unknown": RPCMethodNotFound,
+		} {
+			err := r.Call(context.Background(), method, nil, nil)
+			if !errors.As(err, &rerr) || rerr.Code != code {
+				t.Fatalf("%s: got %v, want code %d", method, err, code)
+			}
+		}
+
+		err := r.Call(context.Background(), "add", "bad", nil)
+		if !errors.As(err, &rerr) || rerr.Code != RPCInvalidParams {
+			t.Fatalf("got %v, want invalid params", err)
+		}
+	})
+
+	t.Run("notify", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		if err := r.Notify("log", "hello"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-notified:
+			if msg != "hello" {
+				t.Fatalf("got %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification not delivered")
+		}
+	})
+
+	t.Run("notify order", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		for i := 0; i < 50; i++ {
+			if err := r.Notify("seq", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			select {
+			case n := <-seq:
+				if n != i {
+					t.Fatalf("got %d, want %d", n, i)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("notification not delivered")
+			}
+		}
+	})
+
+	t.Run("concurrency limit", func(t *testing.T) {
+		r := dialRPC(t, newWSServer(t, serveRPC(reg, func(r *RPC) { r.SetLimit(2, 0) })), nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := r.Call(context.Background(), "busy", nil, nil); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&maxRunning); n != 2 {
+			t.Fatalf("got %d concurrent requests, want 2", n)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		var a, b int
+		batch := []BatchElem{
+			{Method: "add", Params: addParams{A: 1, B: 1}, Result: &a},
+			{Method: "log", Params: "batch", Notify: true},
+			{Method: "unknown"},
+			{Method: "add", Params: addParams{A: 2, B: 3}, Result: &b},
+		}
+		if err := r.BatchCall(context.Background(), batch); err != nil {
+			t.Fatal(err)
+		}
+		if a != 2 || b != 5 || batch[0].Error != nil || batch[3].Error != nil {
+			t.Fatalf("got a=%d b=%d batch=%+v", a, b, batch)
+		}
+		var rerr *RPCError
+		if !errors.As(batch[2].Error, &rerr) || rerr.Code != RPCMethodNotFound {
+			t.Fatalf("got %v, want method not found", batch[2].Error)
+		}
+		if msg := <-notified; msg != "batch" {
+			t.Fatalf("got %q", msg)
+		}
+	})
+
+	t.Run("timeout and cancel", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		r.SetTimeout(50 * time.Millisecond)
+		err := r.Call(context.Background(), "sleep", time.Second, nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want deadline exceeded", err)
+		}
+
+		r.SetTimeout(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		err = r.Call(ctx, "sleep", time.Second, nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want canceled", err)
+		}
+
+		// 连接还可以继续使用
+		var sum int
+		if err = r.Call(context.Background(), "add", addParams{A: 4, B: 4}, &sum); err != nil || sum != 8 {
+			t.Fatalf("sum = %d, err = %v", sum, err)
+		}
+	})
+
+	t.Run("close fails pending", func(t *testing.T) {
+		r := dialRPC(t, ts, nil)
+		time.AfterFunc(50*time.Millisecond, func() {
+			r.Conn().writeErrAndOnClose(NormalClosure, ErrClosed)
+			r.Conn().Close()
+		})
+		err := r.Call(context.Background(), "sleep", time.Second, nil)
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v, want %v", err, ErrClosed)
+		}
+		if err = r.Call(context.Background(), "add", addParams{}, nil); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v after close, want %v", err, ErrClosed)
+		}
+	})
+
+	t.Run("server calls client", func(t *testing.T) {
+		clientReg := NewRPCRegistry()
+		RegisterRPC(clientReg, "name", func(ctx context.Context, c *Conn, p any) (string, error) {
+			return "client", nil
+		})
+
+		srvReg := NewRPCRegistry()
+		RegisterRPC(srvReg, "whoami", func(ctx context.Context, c *Conn, p any) (string, error) {
+			var name string
+			err := c.Callback.(*RPC).Call(ctx, "name", nil, &name)
+			return "hello " + name, err
+		})
+		r := dialRPC(t, newWSServer(t, serveRPC(srvReg)), clientReg)
+
+		var got string
+		if err := r.Call(context.Background(), "whoami", nil, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != "hello client" {
+			t.Fatalf("got %q", got)
+		}
+	})
+}
+
+func Test_RPC_Invalid(t *testing.T) {
+	ts := newWSServer(t, serveRPC(NewRPCRegistry(), func(r *RPC) { r.SetLimit(0, 3) }))
+	c, err := Dial(HTTPToWS(ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, tc := range []struct {
+		req  string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","method":`, RPCParseError},
+		{`[]`, RPCInvalidRequest},
+		{`{"jsonrpc":"1.0","id":1,"method":"x"}`, RPCInvalidRequest},
+		{`[{"jsonrpc":"2.0","id":1,"method":"x"},{},{},{}]`, RPCInvalidRequest},
+	} {
+		if err = c.WriteMessage(Text, []byte(tc.req)); err != nil {
+			t.Fatal(err)
+		}
+		_, rd, err := c.NextReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rsp rpcMessage
+		if err = json.Unmarshal(payload, &rsp); err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Error == nil || rsp.Error.Code != tc.code {
+			t.Fatalf("%s: got %s, want code %d", tc.req, payload, tc.code)
+		}
+	}
+
+	// batch里面格式不对的元素, 每个返回一个RPCInvalidRequest
+	if err = c.WriteMessage(Text, []byte(`[1,{"jsonrpc":"2.0","id":1,"method":"x"},2]`)); err != nil {
+		t.Fatal(err)
+	}
+	_, rd, err := c.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rsps []rpcMessage
+	if err = json.Unmarshal(payload, &rsps); err != nil {
+		t.Fatalf("%s: %v", payload, err)
+	}
+	codes := []int{RPCInvalidRequest, RPCMethodNotFound, RPCInvalidRequest}
+	if len(rsps) != len(codes) {
+		t.Fatalf("got %s", payload)
+	}
+	for i, rsp := range rsps {
+		if rsp.Error == nil || rsp.Error.Code != codes[i] {
+			t.Fatalf("got %s", payload)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/antlabs/wsutil/deflate"
@@ -63,13 +64,31 @@ func subProtocol(subProtocol string, cnf *Config) string {
 			}
 		}
 	}
-	// echo Secf-WebSocket-Protocol 的值
-	return subProtocol
+	// 没有配置或者没有匹配的子协议, 不回复Sec-WebSocket-Protocol
+	// rfc6455 4.2.2, 服务端只能选择自己支持的子协议
+	return ""
+}
+
+// 客户端可能发送多个Sec-WebSocket-Protocol
+func negotiateSubprotocol(r *http.Request, cnf *Config) string {
+	return subProtocol(strings.Join(r.Header.Values(strGetSecWebSocketProtocolKey), ","), cnf)
+}
+
+// 配置了WithServerSubprotocolRequired, 没有匹配的子协议的时候拒绝握手
+func checkSubprotocol(w http.ResponseWriter, r *http.Request, cnf *Config) (string, error) {
+	sub := negotiateSubprotocol(r, cnf)
+	if sub == "" && cnf.subprotocolRequired && len(cnf.subProtocols) > 0 {
+		err := fmt.Errorf("%w: %s", ErrNoMatchingSubprotocol, strings.Join(r.Header.Values(strGetSecWebSocketProtocolKey), ","))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", err
+	}
+	return sub, nil
 }
 
 // https://datatracker.ietf.org/doc/html/rfc6455#section-4.2.2
 // 第5小点
-func prepareWriteResponse(r *http.Request, w io.Writer, cnf *Config, pd deflate.PermessageDeflateConf) (err error) {
+// sub是checkSubprotocol协商出来的子协议, 空字符串的时候不回复Sec-WebSocket-Protocol
+func prepareWriteResponse(r *http.Request, w io.Writer, sub string, pd deflate.PermessageDeflateConf, respHeader http.Header) (err error) {
 	// 写入响应头
 	// 写入Sec-WebSocket-Accept key
 	if _, err = w.Write(bytesHeaderUpgrade); err != nil {
@@ -95,14 +114,19 @@ func prepareWriteResponse(r *http.Request, w io.Writer, cnf *Config, pd deflate.
 		}
 	}
 
-	v = r.Header.Get(strGetSecWebSocketProtocolKey)
-	v = subProtocol(v, cnf)
-	if len(v) > 0 {
+	if len(sub) > 0 {
 		if _, err = w.Write(bytesPutSecWebSocketProtocolKey); err != nil {
 			return
 		}
 
-		if err = writeHeaderVal(w, StringToBytes(v)); err != nil {
+		if err = writeHeaderVal(w, StringToBytes(sub)); err != nil {
+			return err
+		}
+	}
+
+	// 握手钩子添加的响应头
+	if len(respHeader) > 0 {
+		if err = respHeader.Write(w); err != nil {
 			return err
 		}
 	}
@@ -154,3 +178,142 @@ func checkRequest(r *http.Request) (ecode int, err error) {
 	// TODO Sec-WebSocket-Extensions
 	return 0, nil
 }
+
+// 握手被拒绝, 可以用errors.As取出状态码
+// 握手钩子返回*HandshakeError可以自定义状态码和body
+type HandshakeError struct {
+	StatusCode int    // 响应的状态码, 默认是403
+	Body       string // 响应的body, 默认是状态码对应的文本
+	Err        error  // 拒绝的原因
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%s, status code %d", e.Err, e.StatusCode)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// 把握手钩子返回的错误整理成*HandshakeError, 并且可以用errors.Is(err, ErrHandshakeRejected)判断
+func newHandshakeError(err error, reason error) *HandshakeError {
+	var he HandshakeError
+	if e, ok := err.(*HandshakeError); ok {
+		he = *e
+	} else {
+		he.Err = err
+	}
+
+	if he.StatusCode == 0 {
+		he.StatusCode = http.StatusForbidden
+	}
+	if he.Body == "" {
+		he.Body = http.StatusText(he.StatusCode)
+	}
+	if he.Err == nil {
+		he.Err = reason
+	} else if !errors.Is(he.Err, reason) {
+		he.Err = fmt.Errorf("%w: %w", reason, he.Err)
+	}
+	return &he
+}
+
+// 默认的Origin检查, 没有Origin(非浏览器客户端)或者和Host相同才允许
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header["Origin"]
+	if len(origin) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin[0])
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// 协议相关的响应头, 由quickws自己生成, 不能被覆盖
+var protectedResponseHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Version",
+	"Content-Length",
+	"Transfer-Encoding",
+}
+
+// 检查自定义的响应头
+// Sec-WebSocket-Extensions可以用来声明自定义的扩展, 但是permessage-deflate由quickws协商
+func checkResponseHeader(h http.Header) error {
+	for k, vv := range h {
+		ck := http.CanonicalHeaderKey(k)
+		for _, pk := range protectedResponseHeaders {
+			if ck == pk {
+				return fmt.Errorf("%w: %s", ErrProtectedResponseHeader, k)
+			}
+		}
+
+		for _, v := range vv {
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("%w: %s", ErrInvalidResponseHeader, k)
+			}
+			if ck == "Sec-Websocket-Extensions" && strings.Contains(strings.ToLower(v), "permessage-deflate") {
+				return fmt.Errorf("%w: %s %s", ErrProtectedResponseHeader, k, v)
+			}
+		}
+	}
+	return nil
+}
+
+// 合并响应头, key使用规范的格式
+func mergeResponseHeader(dst http.Header, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// 握手准入, 在写101之前调用
+// 通过的时候返回合并之后的响应头(WithServerResponseHeader, Upgrade的参数, 握手钩子), 拒绝的时候写入错误响应
+func admitHandshake(w http.ResponseWriter, r *http.Request, conf *Config, responseHeader []http.Header) (http.Header, error) {
+	checkOrigin := conf.checkOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+
+	if !checkOrigin(r) {
+		he := newHandshakeError(nil, ErrBadOrigin)
+		http.Error(w, he.Body, he.StatusCode)
+		return nil, he
+	}
+
+	h := make(http.Header)
+	mergeResponseHeader(h, conf.responseHeader)
+	for _, rh := range responseHeader {
+		mergeResponseHeader(h, rh)
+	}
+
+	if conf.handshakeHook != nil {
+		if err := conf.handshakeHook(r, h); err != nil {
+			he := newHandshakeError(err, ErrHandshakeRejected)
+			// 拒绝的时候也带上钩子设置的header, 比如WWW-Authenticate, Retry-After
+			for k, v := range h {
+				w.Header()[k] = v
+			}
+			http.Error(w, he.Body, he.StatusCode)
+			return nil, he
+		}
+	}
+
+	if len(h) == 0 {
+		return nil, nil
+	}
+
+	if err := checkResponseHeader(h); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, err
+	}
+	return h, nil
+}
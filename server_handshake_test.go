@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/antlabs/wsutil/deflate"
@@ -91,10 +93,248 @@ func Test_prepareWriteResponse(t *testing.T) {
 	}
 	for i, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := prepareWriteResponse(tt.args.r, tt.w, tt.args.cnf, deflate.PermessageDeflateConf{}); (err != nil) != tt.wantErr {
+			if err := prepareWriteResponse(tt.args.r, tt.w, negotiateSubprotocol(tt.args.r, tt.args.cnf), deflate.PermessageDeflateConf{}, nil); (err != nil) != tt.wantErr {
 				t.Errorf("index:%d, prepareWriteResponse() error = %v, wantErr %v, count= %d", i, err, tt.wantErr, tt.w.(*failWriter).count)
 				return
 			}
 		})
 	}
 }
+
+func newAdmissionServer(t *testing.T, errs chan error, opts ...ServerOption) *httptest.Server {
+	return newHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, opts...)
+		errs <- err
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+}
+
+func wsUpgradeRequest(t *testing.T, url string, origin string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func Test_CheckOrigin(t *testing.T) {
+	t.Run("cross origin rejected by default", func(t *testing.T) {
+		errs := make(chan error, 1)
+		ts := newAdmissionServer(t, errs)
+		defer ts.Close()
+
+		rsp := wsUpgradeRequest(t, ts.URL, "http://evil.example.com")
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusForbidden {
+			t.Fatalf("got status %d", rsp.StatusCode)
+		}
+
+		err := <-errs
+		var he *HandshakeError
+		if !errors.Is(err, ErrBadOrigin) || !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("same origin", func(t *testing.T) {
+		errs := make(chan error, 1)
+		ts := newAdmissionServer(t, errs)
+		defer ts.Close()
+
+		c, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"), WithClientHTTPHeader(http.Header{"Origin": []string{ts.URL}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		errs := make(chan error, 1)
+		ts := newAdmissionServer(t, errs, WithServerCheckOrigin(func(r *http.Request) bool {
+			return r.Header.Get("Origin") == "https://app.example.com"
+		}))
+		defer ts.Close()
+
+		c, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"), WithClientHTTPHeader(http.Header{"Origin": []string{"https://app.example.com"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func Test_HandshakeHook(t *testing.T) {
+	t.Run("reject with custom status", func(t *testing.T) {
+		errs := make(chan error, 1)
+		reason := errors.New("missing token")
+		ts := newAdmissionServer(t, errs, WithServerHandshakeHook(func(r *http.Request, h http.Header) error {
+			h.Set("WWW-Authenticate", "Bearer")
+			return &HandshakeError{StatusCode: http.StatusUnauthorized, Body: "need token", Err: reason}
+		}))
+		defer ts.Close()
+
+		rsp := wsUpgradeRequest(t, ts.URL, "")
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusUnauthorized || strings.TrimSpace(string(body)) != "need token" {
+			t.Fatalf("got status %d, body %q", rsp.StatusCode, body)
+		}
+		if rsp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Fatalf("got header %v", rsp.Header)
+		}
+
+		err := <-errs
+		if !errors.Is(err, ErrHandshakeRejected) || !errors.Is(err, reason) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("reject with plain error", func(t *testing.T) {
+		errs := make(chan error, 1)
+		ts := newAdmissionServer(t, errs, WithServerHandshakeHook(func(r *http.Request, h http.Header) error {
+			return errors.New("deny")
+		}))
+		defer ts.Close()
+
+		_, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"))
+		if !errors.Is(err, ErrWrongStatusCode) {
+			t.Fatalf("got %v", err)
+		}
+
+		var he *HandshakeError
+		if err = <-errs; !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("add response header", func(t *testing.T) {
+		errs := make(chan error, 1)
+		ts := newAdmissionServer(t, errs, WithServerHandshakeHook(func(r *http.Request, h http.Header) error {
+			h.Set("X-Session-Id", "123")
+			return nil
+		}))
+		defer ts.Close()
+
+		var rspHeader http.Header
+		c, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"), WithClientBindHTTPHeader(&rspHeader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if rspHeader.Get("X-Session-Id") != "123" {
+			t.Fatalf("got header %v", rspHeader)
+		}
+	})
+}
+
+func Test_ResponseHeader(t *testing.T) {
+	t.Run("merge", func(t *testing.T) {
+		errs := make(chan error, 1)
+		upgrade := NewUpgrade(
+			WithServerResponseHeader(http.Header{"X-Trace-Id": []string{"abc"}}),
+			WithServerHandshakeHook(func(r *http.Request, h http.Header) error {
+				h.Add("X-Hook", "1")
+				return nil
+			}))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrade.Upgrade(w, r, http.Header{"Set-Cookie": []string{"session=1"}})
+			errs <- err
+			if err == nil {
+				c.Close()
+			}
+		}))
+		defer ts.Close()
+
+		var rspHeader http.Header
+		c, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"), WithClientBindHTTPHeader(&rspHeader))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		if rspHeader.Get("Set-Cookie") != "session=1" || rspHeader.Get("X-Trace-Id") != "abc" ||
+			rspHeader.Get("X-Hook") != "1" {
+			t.Fatalf("got header %v", rspHeader)
+		}
+	})
+
+	for _, h := range []http.Header{
+		{"Connection": []string{"close"}},
+		{"sec-websocket-accept": []string{"x"}},
+		{"Sec-WebSocket-Extensions": []string{"permessage-deflate"}},
+		{"X-Bad": []string{"a\r\nUpgrade: h2c"}},
+	} {
+		errs := make(chan error, 1)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := NewUpgrade().UpgradeV2(w, r, nil, h)
+			errs <- err
+		}))
+
+		_, err := Dial(strings.ReplaceAll(ts.URL, "http", "ws"))
+		if !errors.Is(err, ErrWrongStatusCode) {
+			t.Errorf("%v: got %v", h, err)
+		}
+		err = <-errs
+		if !errors.Is(err, ErrProtectedResponseHeader) && !errors.Is(err, ErrInvalidResponseHeader) {
+			t.Errorf("%v: got %v", h, err)
+		}
+		ts.Close()
+	}
+}
+
+func Test_subProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		client string
+		server []string
+		need   string
+	}{
+		// 服务端没有配置子协议, 不能echo客户端的
+		{name: "not configured", client: "token, chat", need: ""},
+		{name: "match", client: "token, chat", server: []string{"chat"}, need: "chat"},
+		{name: "no match", client: "token", server: []string{"chat"}, need: ""},
+		{name: "mux option", client: MuxSubprotocol, server: appendMuxSubprotocol(nil), need: MuxSubprotocol},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := subProtocol(tc.client, &Config{subProtocols: tc.server}); got != tc.need {
+				t.Errorf("got %q, need %q", got, tc.need)
+			}
+		})
+	}
+
+	t.Run("WithServerMux", func(t *testing.T) {
+		var conf ConnOption
+		WithServerSubprotocols([]string{"chat"})(&conf)
+		WithServerMux(nil)(&conf)
+		WithServerSubprotocols([]string{"json"})(&conf)
+		if got := strings.Join(conf.subProtocols, ","); got != "json,"+MuxSubprotocol {
+			t.Errorf("got %s", got)
+		}
+	})
+}
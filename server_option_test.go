@@ -14,6 +14,7 @@
 package quickws
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -96,4 +97,76 @@ func Test_ServerOption(t *testing.T) {
 			t.Error("header fail")
 		}
 	})
+
+	t.Run("2.4 Subprotocol and Request in OnOpen", func(t *testing.T) {
+		type openInfo struct {
+			sub   string
+			query string
+			token string
+		}
+		opened := make(chan openInfo, 1)
+		upgrade := NewUpgrade(WithServerSubprotocols([]string{"graphql-ws", "mqtt"}), WithServerCallbackFunc(func(c *Conn) {
+			opened <- openInfo{sub: c.Subprotocol(), query: c.Request().URL.Query().Get("room"), token: c.Request().Header.Get("X-Token")}
+		}, nil, nil))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrade.Upgrade(w, r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.StartReadLoop()
+		}))
+
+		defer ts.Close()
+
+		url := strings.ReplaceAll(ts.URL, "http", "ws") + "/?room=1"
+		con, err := Dial(url, WithClientSubprotocols([]string{"foo", "mqtt"}), WithClientHTTPHeader(http.Header{"X-Token": []string{"abc"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer con.Close()
+
+		info := <-opened
+		if info.sub != "mqtt" || info.query != "1" || info.token != "abc" {
+			t.Errorf("got %+v", info)
+		}
+		if con.Subprotocol() != "mqtt" || con.Request() != nil {
+			t.Errorf("client got subprotocol %q", con.Subprotocol())
+		}
+	})
+
+	t.Run("2.5 Subprotocol no match", func(t *testing.T) {
+		for _, required := range []bool{false, true} {
+			errs := make(chan error, 1)
+			opts := []ServerOption{WithServerSubprotocols([]string{"crud", "im"})}
+			if required {
+				opts = append(opts, WithServerSubprotocolRequired())
+			}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Upgrade(w, r, opts...)
+				errs <- err
+				if err == nil {
+					c.Close()
+				}
+			}))
+
+			url := strings.ReplaceAll(ts.URL, "http", "ws")
+			con, err := Dial(url, WithClientSubprotocols([]string{"chat"}))
+			serverErr := <-errs
+			if required {
+				if !errors.Is(err, ErrWrongStatusCode) || !errors.Is(serverErr, ErrNoMatchingSubprotocol) {
+					t.Errorf("got client %v, server %v", err, serverErr)
+				}
+			} else {
+				if err != nil || serverErr != nil {
+					t.Fatalf("got client %v, server %v", err, serverErr)
+				}
+				if con.Subprotocol() != "" {
+					t.Errorf("got subprotocol %q", con.Subprotocol())
+				}
+				con.Close()
+			}
+			ts.Close()
+		}
+	})
 }
@@ -14,8 +14,89 @@
 
 package quickws
 
+import "net/http"
+
 type ServerOption func(*ConnOption)
 
 type ConnOption struct {
 	Config
+	trackConns bool // UpgradeServer是否记录创建的连接, 用于Shutdown
+}
+
+// 配置UpgradeServer记录所有存活的连接, 这样才能使用Shutdown优雅关闭
+// 只对NewUpgrade有效
+func WithServerTrackConns() ServerOption {
+	return func(o *ConnOption) {
+		o.trackConns = true
+	}
+}
+
+// 使用event loop读数据, 调用StartReadLoop的时候注册到el, 不再每个连接一个读go程
+// ReadLoop还是阻塞模式; 开启之后WithServerReadTimeout不生效
+func WithServerEventLoop(el *EventLoop) ServerOption {
+	return func(o *ConnOption) {
+		o.eventLoop = el
+	}
+}
+
+// 检查请求的Origin, 返回false的时候拒绝握手(403, ErrBadOrigin)
+// 默认只允许没有Origin或者Origin和Host相同的请求, 防止跨站websocket劫持
+func WithServerCheckOrigin(f func(r *http.Request) bool) ServerOption {
+	return func(o *ConnOption) {
+		o.checkOrigin = f
+	}
+}
+
+// 握手钩子, 在检查完请求, 写101之前调用
+// h里面设置的header会写到响应里面
+// 返回error拒绝握手, 返回*HandshakeError可以自定义状态码和body, 默认是403
+func WithServerHandshakeHook(f func(r *http.Request, h http.Header) error) ServerOption {
+	return func(o *ConnOption) {
+		o.handshakeHook = f
+	}
+}
+
+// 101响应里面额外的header, 比如Set-Cookie, 链路追踪的id
+// 和Upgrade的responseHeader参数, 握手钩子设置的header合并; 覆盖协议相关的header会拒绝握手(ErrProtectedResponseHeader)
+func WithServerResponseHeader(h http.Header) ServerOption {
+	return func(o *ConnOption) {
+		o.responseHeader = h
+	}
+}
+
+// 配置了WithServerSubprotocols, 客户端的子协议都不匹配的时候拒绝握手(400, ErrNoMatchingSubprotocol)
+// 默认不拒绝, 握手响应里面不带Sec-WebSocket-Protocol
+func WithServerSubprotocolRequired() ServerOption {
+	return func(o *ConnOption) {
+		o.subprotocolRequired = true
+	}
+}
+
+// 握手成功之后, OnOpen之前用握手的请求初始化session, 比如从r.Context()里面取出鉴权中间件设置的用户
+// 对Upgrade, UpgradeV2都有效
+func WithServerSession(f func(r *http.Request) any) ServerOption {
+	return func(o *ConnOption) {
+		o.sessionFunc = f
+	}
+}
+
+// 服务端读限速, 使用令牌桶限制每秒的消息数, 字节数和ping的个数, pong和close不限速
+// 超过之后按照rl.Action处理: 关闭连接(TerminatingConnection), 丢弃, 或者暂停读取
+// 统计数据使用Conn.RateLimitStats获取
+func WithServerRateLimit(rl RateLimit) ServerOption {
+	return func(o *ConnOption) {
+		o.rateLimit = &rl
+	}
+}
+
+// 每个连接一个有界的发送队列, WriteMessage(text, binary)放到队列之后就返回, 由写go程写到socket
+// 队列满了按policy处理; Conn.Flush等待队列写完, Conn.WriteQueueLen获取队列的长度
+// close包排在队列里面的数据后面, WriteCloseTimeout等队列写完才返回; ping和pong不经过队列
+func WithServerWriteQueue(size int, policy WriteQueuePolicy) ServerOption {
+	return func(o *ConnOption) {
+		if size > 0 {
+			o.writeQueueSize = size
+			o.writeQueuePolicy = policy
+		}
+	}
 }
@@ -110,7 +110,7 @@ func Test_Upgrade(t *testing.T) {
 	}
 
 	var out bytes.Buffer
-	err = prepareWriteResponse(r, &out, &Config{}, deflate.PermessageDeflateConf{})
+	err = prepareWriteResponse(r, &out, "", deflate.PermessageDeflateConf{}, nil)
 	if err != nil {
 		t.Error(err)
 		return
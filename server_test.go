@@ -24,6 +24,33 @@ import (
 	"time"
 )
 
+// 测试用的http服务端, 测试结束的时候关闭
+func newHTTPServer(t *testing.T, h http.Handler) *httptest.Server {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// 测试用的websocket服务端, 升级成功之后调用serve, serve为nil的时候直接ReadLoop
+func newWSServer(t *testing.T, serve func(c *Conn), opts ...ServerOption) *httptest.Server {
+	return newHTTPServer(t, wsHandler(t, serve, opts...))
+}
+
+func wsHandler(t *testing.T, serve func(c *Conn), opts ...ServerOption) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, opts...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if serve == nil {
+			_ = c.ReadLoop()
+			return
+		}
+		serve(c)
+	}
+}
+
 // 测试服务端握手失败的情况
 func Test_Server_HandshakeFail(t *testing.T) {
 	// u := NewUpgrade()
@@ -0,0 +1,110 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import "sync"
+
+// 连接上的用户数据, 第一次使用的时候才初始化, 海量连接的时候不占用内存
+// 连接关闭之后清空: ReadLoop模式在OnClose之后, 其他情况在Close的时候
+type session struct {
+	mu  sync.RWMutex
+	val any
+	kv  map[string]any
+}
+
+func (c *Conn) loadSession(create bool) *session {
+	if s := c.sess.Load(); s != nil || !create {
+		return s
+	}
+
+	c.sess.CompareAndSwap(nil, &session{})
+	return c.sess.Load()
+}
+
+func (c *Conn) clearSession() {
+	c.sess.Store(nil)
+}
+
+// 设置连接的session, 比如登录的用户信息
+func (c *Conn) SetSession(v any) {
+	s := c.loadSession(true)
+	s.mu.Lock()
+	s.val = v
+	s.mu.Unlock()
+}
+
+// 获取连接的session, 没有设置或者连接已经关闭返回nil
+func (c *Conn) Session() any {
+	s := c.loadSession(false)
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.val
+}
+
+// 保存一个key/value, 可以并发调用
+func (c *Conn) Store(key string, v any) {
+	s := c.loadSession(true)
+	s.mu.Lock()
+	if s.kv == nil {
+		s.kv = make(map[string]any)
+	}
+	s.kv[key] = v
+	s.mu.Unlock()
+}
+
+// 读取key对应的value
+func (c *Conn) Load(key string) (v any, ok bool) {
+	s := c.loadSession(false)
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok = s.kv[key]
+	return v, ok
+}
+
+// 删除key
+func (c *Conn) Delete(key string) {
+	s := c.loadSession(false)
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.kv, key)
+	s.mu.Unlock()
+}
+
+// 按类型获取session, 类型不对的时候ok是false
+func SessionAs[T any](c *Conn) (v T, ok bool) {
+	v, ok = c.Session().(T)
+	return v, ok
+}
+
+// 按类型获取key对应的value, 不存在或者类型不对的时候ok是false
+func LoadAs[T any](c *Conn, key string) (v T, ok bool) {
+	val, ok := c.Load(key)
+	if !ok {
+		return v, false
+	}
+	v, ok = val.(T)
+	return v, ok
+}
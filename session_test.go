@@ -0,0 +1,152 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	name string
+}
+
+func Test_Session(t *testing.T) {
+	t.Run("server seed", func(t *testing.T) {
+		opened := make(chan string, 1)
+		closed := make(chan string, 1)
+		done := make(chan any, 1)
+		upgrade := NewUpgrade(
+			WithServerSession(func(r *http.Request) any {
+				return &testUser{name: r.Header.Get("X-User")}
+			}),
+			WithServerCallbackFunc(func(c *Conn) {
+				u, _ := SessionAs[*testUser](c)
+				opened <- u.name
+			}, func(c *Conn, op Opcode, payload []byte) {
+				c.Store("last", string(payload))
+				c.Close()
+			}, func(c *Conn, err error) {
+				last, _ := LoadAs[string](c, "last")
+				u, _ := SessionAs[*testUser](c)
+				closed <- u.name + ":" + last
+			}))
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrade.UpgradeV2(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.ReadLoop()
+			done <- c.Session()
+		}))
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL), WithClientHTTPHeader(http.Header{"X-User": []string{"alice"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		if name := <-opened; name != "alice" {
+			t.Fatalf("got %q in OnOpen", name)
+		}
+		if err = c.WriteMessage(Text, []byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-closed:
+			if v != "alice:bye" {
+				t.Fatalf("got %q in OnClose", v)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnClose timeout")
+		}
+		if s := <-done; s != nil {
+			t.Fatalf("session not cleared: %v", s)
+		}
+	})
+
+	t.Run("client seed", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		opened := make(chan any, 1)
+		c, err := Dial(HTTPToWS(ts.URL), WithClientSession("token"), WithClientCallbackFunc(func(c *Conn) {
+			opened <- c.Session()
+		}, nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.ReadLoop()
+
+		if v := <-opened; v != "token" {
+			t.Fatalf("got %v in OnOpen", v)
+		}
+		c.Close()
+	})
+
+	t.Run("close clears", func(t *testing.T) {
+		c := &Conn{}
+		c.SetSession(1)
+		c.Store("k", "v")
+		c.Delete("k")
+		if _, ok := c.Load("k"); ok {
+			t.Fatal("delete fail")
+		}
+		c.Store("k", "v")
+		c.clearSession()
+		if c.Session() != nil {
+			t.Fatal("session not cleared")
+		}
+		if _, ok := c.Load("k"); ok {
+			t.Fatal("kv not cleared")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		c := &Conn{}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprint(i)
+				for j := 0; j < 100; j++ {
+					c.Store(key, j)
+					if _, ok := LoadAs[int](c, key); !ok {
+						t.Error("load fail")
+						return
+					}
+					c.SetSession(j)
+					_ = c.Session()
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
@@ -29,6 +29,7 @@ import (
 
 type UpgradeServer struct {
 	config Config
+	connRegistry
 }
 
 func NewUpgrade(opts ...ServerOption) *UpgradeServer {
@@ -39,15 +40,32 @@ func NewUpgrade(opts ...ServerOption) *UpgradeServer {
 	for _, o := range opts {
 		o(&conf)
 	}
-	return &UpgradeServer{config: conf.Config}
+	u := &UpgradeServer{config: conf.Config}
+	if conf.trackConns {
+		u.conns = make(map[*Conn]struct{})
+	}
+	return u
 }
 
-func (u *UpgradeServer) Upgrade(w http.ResponseWriter, r *http.Request) (c *Conn, err error) {
-	return upgradeInner(w, r, &u.config, nil)
+// responseHeader会合并到101的响应里面, 比如Set-Cookie, 不能覆盖Upgrade, Connection这些协议相关的header
+func (u *UpgradeServer) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader ...http.Header) (c *Conn, err error) {
+	return u.UpgradeV2(w, r, nil, responseHeader...)
 }
 
-func (u *UpgradeServer) UpgradeV2(w http.ResponseWriter, r *http.Request, cb Callback) (c *Conn, err error) {
-	return upgradeInner(w, r, &u.config, cb)
+func (u *UpgradeServer) UpgradeV2(w http.ResponseWriter, r *http.Request, cb Callback, responseHeader ...http.Header) (c *Conn, err error) {
+	if u.isShutdown() {
+		http.Error(w, ErrServerShutdown.Error(), http.StatusServiceUnavailable)
+		return nil, ErrServerShutdown
+	}
+
+	if c, err = upgradeInner(w, r, &u.config, cb, responseHeader...); err != nil {
+		return nil, err
+	}
+
+	if err = u.track(c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func Upgrade(w http.ResponseWriter, r *http.Request, opts ...ServerOption) (c *Conn, err error) {
@@ -61,12 +79,27 @@ func Upgrade(w http.ResponseWriter, r *http.Request, opts ...ServerOption) (c *C
 	return upgradeInner(w, r, &conf.Config, nil)
 }
 
-func upgradeInner(w http.ResponseWriter, r *http.Request, conf *Config, cb Callback) (wsCon *Conn, err error) {
+func upgradeInner(w http.ResponseWriter, r *http.Request, conf *Config, cb Callback, responseHeader ...http.Header) (wsCon *Conn, err error) {
+	// HTTP/2 Extended CONNECT
+	if isExtendedConnect(r) {
+		return upgradeH2(w, r, conf, cb, responseHeader)
+	}
+
 	if ecode, err := checkRequest(r); err != nil {
 		http.Error(w, err.Error(), ecode)
 		return nil, err
 	}
 
+	respHeader, err := admitHandshake(w, r, conf, responseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := checkSubprotocol(w, r, conf)
+	if err != nil {
+		return nil, err
+	}
+
 	hi, ok := w.(http.Hijacker)
 	if !ok {
 		return nil, ErrNotFoundHijacker
@@ -113,7 +146,7 @@ func upgradeInner(w http.ResponseWriter, r *http.Request, conf *Config, cb Callb
 	}()
 
 	resetPermessageDeflate(&pd, conf)
-	if err = prepareWriteResponse(r, tmpWriter, conf, pd); err != nil {
+	if err = prepareWriteResponse(r, tmpWriter, sub, pd, respHeader); err != nil {
 		return
 	}
 
@@ -134,10 +167,16 @@ func upgradeInner(w http.ResponseWriter, r *http.Request, conf *Config, cb Callb
 	}
 
 	wsCon.pd = pd
+	wsCon.subprotocol = sub
+	wsCon.request = r
+	if conf.sessionFunc != nil {
+		wsCon.SetSession(conf.sessionFunc(r))
+	}
 	wsCon.Callback = cb
 	if cb == nil {
 		wsCon.Callback = conf.cb
 	}
+	wsCon.ready()
 	return wsCon, nil
 }
 
@@ -0,0 +1,152 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 记录UpgradeServer创建的连接, conns为nil表示没有开启WithServerTrackConns
+type connRegistry struct {
+	mu       sync.Mutex
+	conns    map[*Conn]struct{}
+	idle     chan struct{} // Shutdown的时候创建, 连接数变成0的时候close
+	shutdown int32
+}
+
+func (r *connRegistry) isShutdown() bool {
+	return atomic.LoadInt32(&r.shutdown) == 1
+}
+
+func (r *connRegistry) track(c *Conn) error {
+	if r.conns == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	if r.isShutdown() {
+		r.mu.Unlock()
+		c.WriteCloseTimeout(EndpointGoingAway, 2*time.Second)
+		c.Close()
+		return ErrServerShutdown
+	}
+	r.conns[c] = struct{}{}
+	c.closeHook = r.untrack
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *connRegistry) untrack(c *Conn) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.notifyIdle()
+	r.mu.Unlock()
+}
+
+// 需要持有mu
+func (r *connRegistry) notifyIdle() {
+	if r.idle == nil || len(r.conns) > 0 {
+		return
+	}
+	select {
+	case <-r.idle:
+	default:
+		close(r.idle)
+	}
+}
+
+// 返回连接数变成0的时候close的chan, 只在Shutdown里面使用, 这时候不会再有新的连接
+func (r *connRegistry) idleChan() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.idle == nil {
+		r.idle = make(chan struct{})
+		r.notifyIdle()
+	}
+	return r.idle
+}
+
+// 当前存活的连接数, 没有开启WithServerTrackConns时返回0
+func (r *connRegistry) ConnCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// 当前所有连接的拷贝
+func (r *connRegistry) snapshot() []*Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*Conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// 发送close包, 等待对端回复
+// 配置了WithServerWriteQueue的时候, close包排在队列里面的数据后面
+func (c *Conn) sendGoingAway() {
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return
+	}
+
+	if err := c.WriteCloseTimeout(EndpointGoingAway, 2*time.Second); err != nil {
+		c.Close()
+	}
+}
+
+// 优雅关闭
+// 1. 不再接受新的升级请求, 返回503
+// 2. 给所有存活的连接发送EndpointGoingAway的close包
+// 3. 等待对端回复close包(需要连接在ReadLoop中), 直到ctx超时
+// 4. 强制关闭剩下的连接, 返回ctx.Err()
+// 需要配置WithServerTrackConns
+func (u *UpgradeServer) Shutdown(ctx context.Context) error {
+	if u.conns == nil {
+		return ErrNotTrackConns
+	}
+
+	atomic.StoreInt32(&u.shutdown, 1)
+	idle := u.idleChan()
+	// 配置了发送队列的连接要等排队的数据写完, 每个连接单独发送, 慢的连接不影响其他连接
+	for _, c := range u.snapshot() {
+		go c.sendGoingAway()
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		for _, c := range u.snapshot() {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// 和http.Server的Shutdown联动, http.Server.Shutdown不会处理被Hijack的连接
+// timeout是等待websocket连接关闭的最长时间
+func (u *UpgradeServer) RegisterOnShutdown(srv *http.Server, timeout time.Duration) {
+	srv.RegisterOnShutdown(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_ = u.Shutdown(ctx)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newShutdownServer(t *testing.T, u *UpgradeServer, opened chan struct{}) *httptest.Server {
+	return newHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.UpgradeV2(w, r, &DefCallback{})
+		if err != nil {
+			return
+		}
+		opened <- struct{}{}
+		_ = c.ReadLoop()
+	}))
+}
+
+func Test_UpgradeServer_Shutdown(t *testing.T) {
+	t.Run("graceful", func(t *testing.T) {
+		u := NewUpgrade(WithServerTrackConns())
+		opened := make(chan struct{}, 3)
+		ts := newShutdownServer(t, u, opened)
+		defer ts.Close()
+
+		url := HTTPToWS(ts.URL)
+		closeErr := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			c, err := Dial(url, WithClientOnCloseFunc(func(c *Conn, err error) {
+				closeErr <- err
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() { _ = c.ReadLoop() }()
+			<-opened
+		}
+
+		if n := u.ConnCount(); n != 3 {
+			t.Fatalf("got %d conns, need 3", n)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := u.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			select {
+			case err := <-closeErr:
+				var msg *CloseErrMsg
+				if !errors.As(err, &msg) || msg.Code != EndpointGoingAway {
+					t.Errorf("got %v, need EndpointGoingAway", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout")
+			}
+		}
+
+		// 关闭之后不再接受新的连接
+		_, err := Dial(url)
+		if err == nil {
+			t.Error("need error")
+		}
+	})
+
+	t.Run("force close", func(t *testing.T) {
+		u := NewUpgrade(WithServerTrackConns())
+		opened := make(chan struct{}, 1)
+		ts := newShutdownServer(t, u, opened)
+		defer ts.Close()
+
+		// 客户端不读数据, 不会回复close包
+		url := HTTPToWS(ts.URL)
+		c, err := Dial(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		<-opened
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := u.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v, need %v", err, context.DeadlineExceeded)
+		}
+		if n := u.ConnCount(); n != 0 {
+			t.Errorf("got %d conns, need 0", n)
+		}
+	})
+
+	t.Run("not track", func(t *testing.T) {
+		u := NewUpgrade()
+		if err := u.Shutdown(context.Background()); !errors.Is(err, ErrNotTrackConns) {
+			t.Errorf("got %v, need %v", err, ErrNotTrackConns)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/antlabs/wsutil/bytespool"
+)
+
+// 发送队列满了之后的处理策略
+type WriteQueuePolicy int
+
+const (
+	// 阻塞调用者, 直到队列有空位, 默认值
+	WriteQueueBlock WriteQueuePolicy = iota
+	// 丢弃队列里面最老的消息
+	WriteQueueDropOldest
+	// 丢弃新的消息, WriteMessage返回ErrWriteQueueFull
+	WriteQueueDropNewest
+	// 使用TerminatingConnection关闭连接, WriteMessage返回ErrWriteQueueFull
+	WriteQueueClose
+)
+
+type writeQueueItem struct {
+	op  Opcode
+	buf *[]byte
+	pm  *PreparedMessage // WritePreparedMessage放进来的消息, buf是nil
+}
+
+func (m *writeQueueItem) free() {
+	if m.buf != nil {
+		bytespool.PutBytes(m.buf)
+	}
+}
+
+// 每个连接的发送队列, text和binary消息先放到队列, 由写go程写到socket
+// 写go程只在队列有数据的时候运行, 写完就退出, 海量连接的时候不会常驻go程
+// close包也放到队列, 保证在排队的数据后面发送; ping和pong不经过队列, 直接写
+type writeQueue struct {
+	mu      sync.Mutex
+	items   []writeQueueItem
+	size    int
+	policy  WriteQueuePolicy
+	running bool          // 写go程是否在运行
+	closed  bool          // 连接已经关闭
+	closing bool          // close包已经放到队列, 后面不能再发送数据
+	err     error         // 写socket的错误, 之后的WriteMessage都返回这个错误
+	changed chan struct{} // 状态变化的时候close, 用于等待
+	dropped uint64
+}
+
+func newWriteQueue(size int, policy WriteQueuePolicy) *writeQueue {
+	return &writeQueue{size: size, policy: policy, changed: make(chan struct{})}
+}
+
+// 需要持有mu
+func (q *writeQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// 是否经过发送队列, text和binary之外close包也要排在已经放到队列的数据后面, ping和pong直接写
+func (c *Conn) queued(op Opcode) bool {
+	return c.wq != nil && (op == Text || op == Binary || op == Close)
+}
+
+// 放到发送队列, 数据会被复制, 调用者可以复用writeBuf
+func (c *Conn) enqueueMessage(op Opcode, writeBuf []byte) error {
+	return c.enqueue(writeQueueItem{op: op}, writeBuf)
+}
+
+// 放到发送队列, PreparedMessage是只读的, 不需要复制
+func (c *Conn) enqueuePreparedMessage(pm *PreparedMessage) error {
+	return c.enqueue(writeQueueItem{op: pm.op, pm: pm}, nil)
+}
+
+func (c *Conn) enqueue(item writeQueueItem, writeBuf []byte) error {
+	q := c.wq
+	q.mu.Lock()
+	for {
+		if q.err != nil {
+			err := q.err
+			q.mu.Unlock()
+			return err
+		}
+		if q.closed || q.closing {
+			q.mu.Unlock()
+			return ErrClosed
+		}
+		// close包不受队列长度的限制, 不会被丢弃
+		if len(q.items) < q.size || item.op == Close {
+			break
+		}
+
+		switch q.policy {
+		case WriteQueueDropOldest:
+			q.items[0].free()
+			q.items[0] = writeQueueItem{}
+			q.items = q.items[1:]
+			atomic.AddUint64(&q.dropped, 1)
+		case WriteQueueDropNewest:
+			atomic.AddUint64(&q.dropped, 1)
+			q.mu.Unlock()
+			return ErrWriteQueueFull
+		case WriteQueueClose:
+			atomic.AddUint64(&q.dropped, 1)
+			q.mu.Unlock()
+			go func() {
+				c.writeErrAndOnClose(TerminatingConnection, ErrWriteQueueFull)
+				c.Close()
+			}()
+			return ErrWriteQueueFull
+		default:
+			ch := q.changed
+			q.mu.Unlock()
+			<-ch
+			q.mu.Lock()
+		}
+	}
+
+	if item.pm == nil {
+		item.buf = bytespool.GetBytes(len(writeBuf))
+		*item.buf = append((*item.buf)[:0], writeBuf...)
+	}
+	q.items = append(q.items, item)
+	if item.op == Close {
+		q.closing = true
+	}
+	if !q.running {
+		q.running = true
+		go c.drainWriteQueue()
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// 写go程, 队列空了就退出
+func (c *Conn) drainWriteQueue() {
+	q := c.wq
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 || q.closed || q.err != nil {
+			q.running = false
+			q.notify()
+			q.mu.Unlock()
+			return
+		}
+		m := q.items[0]
+		q.items[0] = writeQueueItem{}
+		q.items = q.items[1:]
+		// 有空位了, 唤醒阻塞的WriteMessage
+		q.notify()
+		q.mu.Unlock()
+
+		var err error
+		if m.pm != nil {
+			err = c.writePreparedMessage(m.pm)
+		} else {
+			err = c.writeMessage(m.op, *m.buf)
+		}
+		m.free()
+		if err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.mu.Unlock()
+		}
+	}
+}
+
+// 连接关闭的时候, 丢弃没有发送的消息
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for i := range q.items {
+		q.items[i].free()
+	}
+	q.items = nil
+	q.notify()
+}
+
+// 等待发送队列里面的消息都写到socket
+// 没有配置WithServerWriteQueue的时候直接返回
+func (c *Conn) Flush(ctx context.Context) error {
+	q := c.wq
+	if q == nil {
+		return nil
+	}
+
+	for {
+		q.mu.Lock()
+		if q.err != nil {
+			err := q.err
+			q.mu.Unlock()
+			return err
+		}
+		if len(q.items) == 0 && !q.running {
+			q.mu.Unlock()
+			return nil
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return ErrClosed
+		}
+		ch := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// 发送队列里面等待写的消息个数
+func (c *Conn) WriteQueueLen() int {
+	q := c.wq
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// 因为发送队列满了被丢弃的消息个数
+func (c *Conn) WriteQueueDropped() uint64 {
+	if c.wq == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.wq.dropped)
+}
@@ -0,0 +1,220 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package quickws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antlabs/wsutil/fixedreader"
+)
+
+// 写会阻塞在gate上, 模拟读得很慢的对端
+type gateConn struct {
+	net.Conn
+	gate chan struct{}
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func (g *gateConn) Write(p []byte) (int, error) {
+	<-g.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.buf = append(g.buf, p...)
+	return len(p), nil
+}
+
+func (g *gateConn) Close() error                       { return nil }
+func (g *gateConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// 解析写出去的小数据帧(payload < 126, 没有mask)
+func (g *gateConn) messages() (msgs []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for b := g.buf; len(b) >= 2; {
+		n := int(b[1] & 0x7f)
+		if Opcode(b[0]&0xf) != Close {
+			msgs = append(msgs, string(b[2:2+n]))
+		}
+		b = b[2+n:]
+	}
+	return msgs
+}
+
+// 写出去的帧的opcode, 按顺序
+func (g *gateConn) opcodes() (ops []Opcode) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for b := g.buf; len(b) >= 2; {
+		ops = append(ops, Opcode(b[0]&0xf))
+		b = b[2+int(b[1]&0x7f):]
+	}
+	return ops
+}
+
+func newWriteQueueConn(t *testing.T, size int, policy WriteQueuePolicy, closed chan error) (*Conn, *gateConn) {
+	var conf ConnOption
+	if err := conf.defaultSetting(); err != nil {
+		t.Fatal(err)
+	}
+	WithServerWriteQueue(size, policy)(&conf)
+	WithServerOnCloseFunc(func(c *Conn, err error) { closed <- err })(&conf)
+
+	g := &gateConn{gate: make(chan struct{})}
+	c, err := newConn(g, false, &conf.Config, fixedreader.FixedReader{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Callback = conf.cb
+	return c, g
+}
+
+// 第一个消息被写go程取走, 阻塞在socket上, 后面的消息留在队列里面
+func fillWriteQueue(t *testing.T, c *Conn, msgs ...string) {
+	for i, m := range msgs {
+		if err := c.WriteMessage(Text, []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			for c.WriteQueueLen() != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+}
+
+func Test_WriteQueue(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 1, WriteQueueBlock, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2")
+
+		done := make(chan error, 1)
+		go func() { done <- c.WriteMessage(Text, []byte("m3")) }()
+		select {
+		case err := <-done:
+			t.Fatalf("not blocked: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := c.Flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v", err)
+		}
+
+		close(g.gate)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2,m3" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 2, WriteQueueDropOldest, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2", "m3", "m4")
+		if c.WriteQueueLen() != 2 || c.WriteQueueDropped() != 1 {
+			t.Fatalf("len %d, dropped %d", c.WriteQueueLen(), c.WriteQueueDropped())
+		}
+
+		close(g.gate)
+		if err := c.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m3,m4" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 2, WriteQueueDropNewest, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2", "m3")
+		if err := c.WriteMessage(Text, []byte("m4")); !errors.Is(err, ErrWriteQueueFull) {
+			t.Fatalf("got %v", err)
+		}
+
+		close(g.gate)
+		if err := c.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(g.messages(), ","); got != "m1,m2,m3" {
+			t.Fatalf("got %s", got)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		closed := make(chan error, 1)
+		c, g := newWriteQueueConn(t, 1, WriteQueueClose, closed)
+		fillWriteQueue(t, c, "m1", "m2")
+		if err := c.WriteMessage(Text, []byte("m3")); !errors.Is(err, ErrWriteQueueFull) {
+			t.Fatalf("got %v", err)
+		}
+
+		close(g.gate)
+		select {
+		case err := <-closed:
+			if !errors.Is(err, ErrWriteQueueFull) {
+				t.Fatalf("got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("OnClose timeout")
+		}
+
+		for !c.isClosed() {
+			time.Sleep(time.Millisecond)
+		}
+		if err := c.WriteMessage(Text, []byte("m4")); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("close after data", func(t *testing.T) {
+		c, g := newWriteQueueConn(t, 1, WriteQueueDropNewest, make(chan error, 1))
+		fillWriteQueue(t, c, "m1", "m2")
+
+		// 队列满了, close包也不会被丢弃, 并且等排队的数据写完
+		done := make(chan error, 1)
+		go func() { done <- c.WriteCloseTimeout(NormalClosure, time.Second) }()
+		for c.WriteQueueLen() != 2 {
+			time.Sleep(time.Millisecond)
+		}
+		if err := c.WriteMessage(Text, []byte("m3")); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v", err)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("close returned before the queue was written: %v", err)
+		default:
+		}
+
+		close(g.gate)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		ops := g.opcodes()
+		if len(ops) != 3 || ops[len(ops)-1] != Close {
+			t.Fatalf("got %v", ops)
+		}
+	})
+}
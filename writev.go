@@ -0,0 +1,192 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+
+	"github.com/antlabs/wsutil/bytespool"
+	"github.com/antlabs/wsutil/enum"
+	"github.com/antlabs/wsutil/fixedwriter"
+	"github.com/antlabs/wsutil/frame"
+	"github.com/antlabs/wsutil/mask"
+	"github.com/antlabs/wsutil/opcode"
+)
+
+// payload不小于这个值的时候才使用writev, 小消息复制一次比writev便宜, 见Benchmark_WriteMessage_Writev
+const writevThreshold = 64 * 1024
+
+// WriteMessages使用的消息
+type Message struct {
+	Op      Opcode
+	Payload []byte
+}
+
+// 只有基于fd的连接, net.Buffers才会使用writev一次写完
+// tls等其他连接会退化成多次Write, 并发写的时候帧会交错, 所以不能使用
+func canWritev(nc net.Conn) bool {
+	switch nc.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// payload是否可以不复制直接放到writev里面
+// 客户端需要mask, 只有payload是自己的内存(比如压缩之后的)才可以原地mask
+func (c *Conn) useWritev(payloadLen int, owned bool) bool {
+	return c.writev && payloadLen >= writevThreshold && (!c.client || owned)
+}
+
+// 写一个完整的帧, owned为true表示payload可以被修改
+func (c *Conn) writeFrame(op Opcode, payload []byte, rsv1 bool, owned bool) (err error) {
+	maskValue := uint32(0)
+	if c.client {
+		maskValue = rand.Uint32()
+	}
+
+	if !c.useWritev(len(payload), owned) {
+		var fw fixedwriter.FixedWriter
+		return frame.WriteFrame(&fw, c.c, payload, true, rsv1, c.client, op, maskValue)
+	}
+
+	// header和payload使用writev一起写, 省掉payload的复制
+	var head [enum.MaxFrameHeaderSize]byte
+	n, err := frame.WriteHeader(head[:], true, rsv1, false, false, op, len(payload), c.client, maskValue)
+	if err != nil {
+		return err
+	}
+	if c.client {
+		mask.Mask(payload, maskValue)
+	}
+	bufs := net.Buffers{head[:n], payload}
+	_, err = bufs.WriteTo(c.c)
+	return err
+}
+
+// 批量写消息, 所有的帧合并成一次系统调用(tcp连接上使用writev)
+// 只支持Text和Binary, 配置了WithServerWriteQueue的时候按顺序放到发送队列
+func (c *Conn) WriteMessages(msgs []Message) (err error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return ErrClosed
+	}
+
+	for _, m := range msgs {
+		if m.Op != opcode.Text && m.Op != opcode.Binary {
+			return ErrOpcode
+		}
+		if m.Op == opcode.Text && !c.utf8Check(m.Payload) {
+			return ErrTextNotUTF8
+		}
+	}
+
+	if c.wq != nil {
+		for _, m := range msgs {
+			if err = c.enqueueMessage(m.Op, m.Payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.writeMessages(msgs)
+}
+
+func (c *Conn) writeMessages(msgs []Message) (err error) {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	// 压缩之后的payload, 写完之后还给pool
+	var encoded []*[]byte
+	defer func() {
+		for _, p := range encoded {
+			bytespool.PutBytes(p)
+		}
+	}()
+
+	payloads := make([][]byte, len(msgs))
+	owned := make([]bool, len(msgs))      // payload可以被修改
+	compressed := make([]bool, len(msgs)) // 设置rsv1
+	copySize := 0
+	for i, m := range msgs {
+		payloads[i] = m.Payload
+		if c.pd.Compression {
+			p, err := c.encoode(&payloads[i])
+			if err != nil {
+				return err
+			}
+			encoded = append(encoded, p)
+			payloads[i], owned[i], compressed[i] = *p, true, true
+		}
+
+		copySize += enum.MaxFrameHeaderSize
+		if !c.useWritev(len(payloads[i]), owned[i]) {
+			copySize += len(payloads[i])
+		}
+	}
+
+	// 小的帧和所有的header复制到一块内存, 大的payload直接引用
+	buf := bytespool.GetBytes(copySize)
+	defer bytespool.PutBytes(buf)
+	out := (*buf)[:0]
+	bufs := make(net.Buffers, 0, 2*len(msgs))
+	start := 0
+	for i, m := range msgs {
+		maskValue := uint32(0)
+		if c.client {
+			maskValue = rand.Uint32()
+		}
+
+		n, err := frame.WriteHeader(out[len(out):len(out)+enum.MaxFrameHeaderSize], true, compressed[i], false, false, m.Op, len(payloads[i]), c.client, maskValue)
+		if err != nil {
+			return err
+		}
+		out = out[:len(out)+n]
+
+		if c.useWritev(len(payloads[i]), owned[i]) {
+			if c.client {
+				mask.Mask(payloads[i], maskValue)
+			}
+			bufs = append(bufs, out[start:], payloads[i])
+			start = len(out)
+			continue
+		}
+
+		pos := len(out)
+		out = append(out, payloads[i]...)
+		if c.client {
+			mask.Mask(out[pos:], maskValue)
+		}
+	}
+	if start < len(out) {
+		bufs = append(bufs, out[start:])
+	}
+
+	if len(bufs) == 1 {
+		_, err = c.c.Write(bufs[0])
+	} else {
+		_, err = bufs.WriteTo(c.c)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, m := range msgs {
+		c.observeFrameWrite(m.Op, true, len(payloads[i]))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2021-2024 antlabs. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quickws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBatch() []Message {
+	return []Message{
+		{Op: Text, Payload: []byte("hello")},
+		{Op: Binary, Payload: bytes.Repeat([]byte{1}, 64*1024)},
+		{Op: Binary, Payload: []byte{2, 3}},
+		{Op: Text, Payload: []byte(strings.Repeat("a", writevThreshold))},
+	}
+}
+
+func recvBatch(t *testing.T, got chan Message, want []Message) {
+	for i, w := range want {
+		select {
+		case m := <-got:
+			if m.Op != w.Op || !bytes.Equal(m.Payload, w.Payload) {
+				t.Fatalf("message %d: got op %v len %d", i, m.Op, len(m.Payload))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d timeout", i)
+		}
+	}
+}
+
+func Test_WriteMessages(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var serverOpts []ServerOption
+		var clientOpts []ClientOption
+		name := "plain"
+		if compress {
+			serverOpts = append(serverOpts, WithServerDecompressAndCompress())
+			clientOpts = append(clientOpts, WithClientDecompressAndCompress())
+			name = "compress"
+		}
+
+		t.Run(name+".server", func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Upgrade(w, r, append(serverOpts, WithServerCallbackFunc(func(c *Conn) {
+					if err := c.WriteMessages(testBatch()); err != nil {
+						t.Error(err)
+					}
+				}, nil, nil))...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.ReadLoop()
+			}))
+			defer ts.Close()
+
+			got := make(chan Message, 8)
+			c, err := Dial(HTTPToWS(ts.URL), append(clientOpts, WithClientOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+				got <- Message{Op: op, Payload: append([]byte(nil), payload...)}
+			}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			go c.ReadLoop()
+
+			recvBatch(t, got, testBatch())
+		})
+
+		t.Run(name+".client", func(t *testing.T) {
+			got := make(chan Message, 8)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Upgrade(w, r, append(serverOpts, WithServerOnMessageFunc(func(c *Conn, op Opcode, payload []byte) {
+					got <- Message{Op: op, Payload: append([]byte(nil), payload...)}
+				}))...)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.ReadLoop()
+			}))
+			defer ts.Close()
+
+			c, err := Dial(HTTPToWS(ts.URL), clientOpts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// 客户端需要mask, 不能修改调用者的payload
+			msgs := testBatch()
+			if err = c.WriteMessages(msgs); err != nil {
+				t.Fatal(err)
+			}
+			if err = c.WriteMessage(Binary, msgs[1].Payload); err != nil {
+				t.Fatal(err)
+			}
+			recvBatch(t, got, append(testBatch(), testBatch()[1]))
+			for i, m := range testBatch() {
+				if !bytes.Equal(msgs[i].Payload, m.Payload) {
+					t.Fatalf("payload %d modified", i)
+				}
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Upgrade(w, r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.ReadLoop()
+		}))
+		defer ts.Close()
+
+		c, err := Dial(HTTPToWS(ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.WriteMessages([]Message{{Op: Ping}}); !errors.Is(err, ErrOpcode) {
+			t.Fatalf("got %v", err)
+		}
+		if err = c.WriteMessages(nil); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if err = c.WriteMessages([]Message{{Op: Text}}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("got %v", err)
+		}
+	})
+}